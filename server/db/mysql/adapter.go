@@ -3,14 +3,22 @@
 package mysql
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"hash/fnv"
+	"io/ioutil"
 	"log"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	ms "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
@@ -24,25 +32,101 @@ type adapter struct {
 	db     *sqlx.DB
 	dsn    string
 	dbName string
+	// Optional connection to a read replica.
+	rdb *sqlx.DB
 	// Maximum number of records to return
 	maxResults int
 	version    int
+	// Optional callback invoked after each instrumented call.
+	queryHook func(method string, dur time.Duration, err error)
+	// Maximum number of values in a single IN (...) clause.
+	inBatchSize int
+	// Number of times to retry a transaction which failed with a transient error.
+	maxRetries int
+	// Delay before the first retry, doubled on each subsequent attempt.
+	retryBackoff time.Duration
+	// Record saved messages in the outbox table.
+	outbox bool
+	// Keep prior versions of edited messages.
+	editHistory bool
 }
 
 const (
 	defaultDSN      = "root:@tcp(localhost:3306)/tinode?parseTime=true"
 	defaultDatabase = "tinode"
 
-	adpVersion = 108
+	adpVersion = 117
 
 	adapterName = "mysql"
 
 	defaultMaxResults = 1024
+
+	// Connection pool defaults.
+	defaultMaxOpenConns    = 50
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = 60
+
+	// Maximum number of values in an IN (...) clause. MySQL limits the number of
+	// placeholders in a prepared statement to 65535.
+	defaultInBatchSize = 4096
+	maxInBatchSize     = 65535
+
+	// Retries of transactions which failed with a transient error.
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 50 // milliseconds
+
+	// Timeout of the initial connection to the database.
+	defaultConnectTimeout = 5 // seconds
+
+	// Name under which the custom TLS config is registered with the driver.
+	tlsConfigName = "tinode"
+
+	// Maximum length of a tag in characters, the size of the tag column.
+	maxTagLength = 96
+)
+
+var (
+	// ErrDbMissing is returned by GetDbVersion when the database does not exist.
+	ErrDbMissing = errors.New("Database not initialized: database does not exist")
+	// ErrDbNotInitialized is returned by GetDbVersion when the database exists but has no version record.
+	ErrDbNotInitialized = errors.New("Database not initialized: version is missing")
 )
 
 type configType struct {
 	DSN    string `json:"dsn,omitempty"`
 	DBName string `json:"database,omitempty"`
+	// Maximum number of open connections to the database.
+	MaxOpenConns int `json:"max_open_conns,omitempty"`
+	// Maximum number of connections in the idle connection pool.
+	MaxIdleConns int `json:"max_idle_conns,omitempty"`
+	// Maximum amount of time a connection may be reused, in seconds.
+	ConnMaxLifetime int `json:"conn_max_lifetime,omitempty"`
+	// Maximum number of values in a single IN (...) clause. Longer lists are queried in batches.
+	InBatchSize int `json:"in_batch_size,omitempty"`
+	// Optional DSN of a read replica. Heavy read-only queries are sent to it.
+	ReadDSN string `json:"read_dsn,omitempty"`
+	// Number of times to retry a transaction on deadlock, lock wait timeout or a connection
+	// failure. Negative value disables retries.
+	MaxRetries int `json:"max_retries,omitempty"`
+	// Delay before the first retry in milliseconds, doubled on each subsequent retry.
+	RetryBackoff int `json:"retry_backoff,omitempty"`
+	// Maximum time in seconds to wait for the connection to the database to be established.
+	ConnectTimeout int `json:"connect_timeout,omitempty"`
+	// Record saved messages in the outbox table to be picked up by an external relay.
+	Outbox bool `json:"outbox,omitempty"`
+	// Keep prior versions of edited messages in the msgedits table.
+	EditHistory bool `json:"edit_history,omitempty"`
+	// Maximum execution time of a SELECT statement in milliseconds, enforced by the server.
+	StatementTimeout int `json:"statement_timeout,omitempty"`
+	// Log all SQL statements with their arguments. Secrets and credential values are redacted.
+	LogQueries bool `json:"log_queries,omitempty"`
+	// TLS mode: "true", "false", "skip-verify" or "preferred". Overrides the 'tls' parameter of the DSN.
+	TLS string `json:"tls,omitempty"`
+	// Optional PEM-encoded CA certificate to verify the server with.
+	TLSRootCert string `json:"tls_root_cert,omitempty"`
+	// Optional PEM-encoded client certificate and key.
+	TLSCert string `json:"tls_cert,omitempty"`
+	TLSKey  string `json:"tls_key,omitempty"`
 }
 
 // Open initializes database session
@@ -63,23 +147,65 @@ func (a *adapter) Open(jsonconfig string) error {
 		a.dsn = defaultDSN
 	}
 
+	// The 'database' from config takes precedence over the database name in the DSN so that
+	// CreateDb and all other queries use the same database. Several deployments may share
+	// one MySQL server by using different databases.
+	cfg, err := ms.ParseDSN(a.dsn)
+	if err != nil {
+		return errors.New("mysql adapter failed to parse DSN: " + err.Error())
+	}
 	a.dbName = config.DBName
+	if a.dbName == "" {
+		a.dbName = cfg.DBName
+	}
 	if a.dbName == "" {
 		a.dbName = defaultDatabase
 	}
 
+	if a.dsn, err = prepareDSN(a.dsn, a.dbName, &config); err != nil {
+		return err
+	}
+
 	if a.maxResults <= 0 {
 		a.maxResults = defaultMaxResults
 	}
 
-	// This just initializes the driver but does not open the network connection.
-	a.db, err = sqlx.Open("mysql", a.dsn)
-	if err != nil {
+	a.inBatchSize = config.InBatchSize
+	if a.inBatchSize <= 0 || a.inBatchSize > maxInBatchSize {
+		a.inBatchSize = defaultInBatchSize
+	}
+
+	a.maxRetries = config.MaxRetries
+	if a.maxRetries == 0 {
+		a.maxRetries = defaultMaxRetries
+	}
+	a.retryBackoff = time.Duration(config.RetryBackoff) * time.Millisecond
+	if a.retryBackoff <= 0 {
+		a.retryBackoff = defaultRetryBackoff * time.Millisecond
+	}
+
+	a.outbox = config.Outbox
+	a.editHistory = config.EditHistory
+
+	if a.db, err = openPool(a.dsn, &config); err != nil {
 		return err
 	}
 
+	if config.ReadDSN != "" {
+		var rdsn string
+		if rdsn, err = prepareDSN(config.ReadDSN, a.dbName, &config); err != nil {
+			return err
+		}
+		if a.rdb, err = openPool(rdsn, &config); err != nil {
+			return err
+		}
+		if err = ping(a.rdb, &config); err != nil && !isMissingDb(err) {
+			return errors.New("mysql adapter failed to connect to read replica: " + err.Error())
+		}
+	}
+
 	// Actually opening the network connection.
-	err = a.db.Ping()
+	err = ping(a.db, &config)
 	if isMissingDb(err) {
 		// Ignore missing database here. If we are initializing the database
 		// missing DB is OK.
@@ -88,11 +214,344 @@ func (a *adapter) Open(jsonconfig string) error {
 	return err
 }
 
+// ping opens the network connection to the database. Fails if the connection is not established
+// within the configured timeout.
+func ping(db *sqlx.DB, config *configType) error {
+	timeout := time.Duration(config.ConnectTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout * time.Second
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := db.PingContext(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return errors.New("mysql adapter timed out connecting to the database after " + timeout.String())
+	}
+	return err
+}
+
+// prepareDSN replaces the database name in the DSN and merges TLS settings into it.
+func prepareDSN(dsn, dbName string, config *configType) (string, error) {
+	cfg, err := ms.ParseDSN(dsn)
+	if err != nil {
+		return "", errors.New("mysql adapter failed to parse DSN: " + err.Error())
+	}
+	cfg.DBName = dbName
+
+	if config.StatementTimeout > 0 {
+		// The driver sets system variables from DSN parameters on every new connection.
+		// MySQL applies max_execution_time to read-only SELECT statements only, thus table
+		// maintenance and writes are not affected.
+		if cfg.Params == nil {
+			cfg.Params = map[string]string{}
+		}
+		cfg.Params["max_execution_time"] = strconv.Itoa(config.StatementTimeout)
+	}
+
+	if dsn, err = dsnWithTLS(cfg.FormatDSN(), config); err != nil {
+		return "", errors.New("mysql adapter failed to configure TLS: " + err.Error())
+	}
+	return dsn, nil
+}
+
+// openPool initializes a connection pool. It does not open the network connection.
+func openPool(dsn string, config *configType) (*sqlx.DB, error) {
+	var db *sqlx.DB
+	if config.LogQueries {
+		db = sqlx.NewDb(sql.OpenDB(&loggingConnector{dsn: dsn, drv: &ms.MySQLDriver{}, logf: log.Printf}), "mysql")
+	} else {
+		var err error
+		if db, err = sqlx.Open("mysql", dsn); err != nil {
+			return nil, err
+		}
+	}
+
+	maxOpenConns := config.MaxOpenConns
+	if maxOpenConns <= 0 {
+		maxOpenConns = defaultMaxOpenConns
+	}
+	maxIdleConns := config.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+	connMaxLifetime := config.ConnMaxLifetime
+	if connMaxLifetime <= 0 {
+		connMaxLifetime = defaultConnMaxLifetime
+	}
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(connMaxLifetime) * time.Second)
+
+	return db, nil
+}
+
+// loggingConnector opens connections which log every statement executed through them.
+type loggingConnector struct {
+	dsn  string
+	drv  driver.Driver
+	logf func(format string, args ...interface{})
+}
+
+func (c *loggingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := c.drv.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &loggingConn{Conn: conn, logf: c.logf}, nil
+}
+
+func (c *loggingConnector) Driver() driver.Driver {
+	return c.drv
+}
+
+// loggingConn logs statements executed directly on the connection or through prepared statements.
+// The driver returns driver.ErrSkip from ExecContext and QueryContext when the arguments are not
+// interpolated on the client, then the statement is prepared and logged when executed.
+type loggingConn struct {
+	driver.Conn
+	logf func(format string, args ...interface{})
+}
+
+func (c *loggingConn) log(query string, args []driver.NamedValue, start time.Time, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	if err != nil {
+		c.logf("mysql: %s %v (%s): %v", query, redactArgs(query, args), time.Since(start), err)
+	} else {
+		c.logf("mysql: %s %v (%s)", query, redactArgs(query, args), time.Since(start))
+	}
+}
+
+func (c *loggingConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	var stmt driver.Stmt
+	var err error
+	if pc, ok := c.Conn.(driver.ConnPrepareContext); ok {
+		stmt, err = pc.PrepareContext(ctx, query)
+	} else {
+		stmt, err = c.Conn.Prepare(query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &loggingStmt{Stmt: stmt, conn: c, query: query}, nil
+}
+
+func (c *loggingConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if bt, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return bt.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+func (c *loggingConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	ec, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := ec.ExecContext(ctx, query, args)
+	c.log(query, args, start, err)
+	return res, err
+}
+
+func (c *loggingConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	qc, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := qc.QueryContext(ctx, query, args)
+	c.log(query, args, start, err)
+	return rows, err
+}
+
+func (c *loggingConn) Ping(ctx context.Context) error {
+	if p, ok := c.Conn.(driver.Pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+func (c *loggingConn) CheckNamedValue(nv *driver.NamedValue) error {
+	if nc, ok := c.Conn.(driver.NamedValueChecker); ok {
+		return nc.CheckNamedValue(nv)
+	}
+	return driver.ErrSkip
+}
+
+func (c *loggingConn) ResetSession(ctx context.Context) error {
+	if sr, ok := c.Conn.(driver.SessionResetter); ok {
+		return sr.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *loggingConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+// loggingStmt logs executions of a prepared statement.
+type loggingStmt struct {
+	driver.Stmt
+	conn  *loggingConn
+	query string
+}
+
+func (s *loggingStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	var res driver.Result
+	var err error
+	if ec, ok := s.Stmt.(driver.StmtExecContext); ok {
+		res, err = ec.ExecContext(ctx, args)
+	} else {
+		res, err = s.Stmt.Exec(namedToValues(args))
+	}
+	s.conn.log(s.query, args, start, err)
+	return res, err
+}
+
+func (s *loggingStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	if qc, ok := s.Stmt.(driver.StmtQueryContext); ok {
+		rows, err = qc.QueryContext(ctx, args)
+	} else {
+		rows, err = s.Stmt.Query(namedToValues(args))
+	}
+	s.conn.log(s.query, args, start, err)
+	return rows, err
+}
+
+func namedToValues(args []driver.NamedValue) []driver.Value {
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return values
+}
+
+// redactedColumns are the columns whose values are never logged: auth secrets and login names,
+// credential values and responses.
+var redactedColumns = map[string]bool{"secret": true, "uname": true, "value": true, "resp": true}
+
+// insertColumns matches the column list of an INSERT ... VALUES statement.
+var insertColumns = regexp.MustCompile("(?is)^\\s*INSERT\\s+(?:IGNORE\\s+)?INTO\\s+[\\w`.]+\\s*\\(([^)]*)\\)\\s*VALUES")
+
+// redactArgs returns statement arguments suitable for logging. Values bound to redactedColumns
+// are masked regardless of the table. Arguments which cannot be matched to a column are masked too.
+func redactArgs(query string, args []driver.NamedValue) []interface{} {
+	cols := placeholderColumns(query)
+	out := make([]interface{}, len(args))
+	for i, arg := range args {
+		if i >= len(cols) || redactedColumns[cols[i]] {
+			out[i] = "[redacted]"
+		} else {
+			out[i] = arg.Value
+		}
+	}
+	return out
+}
+
+// placeholderColumns returns the name of the column each placeholder of the query is bound to.
+// In the VALUES of an INSERT the placeholders are matched to the column list. Elsewhere
+// a placeholder is bound to the nearest column on its left, as in "secret=?", "tag IN (?)" or
+// "GREATEST(seqid,?)". The result is approximate but sufficient for statements of this adapter.
+func placeholderColumns(query string) []string {
+	var insertCols []string
+	if m := insertColumns.FindStringSubmatch(query); m != nil {
+		for _, col := range strings.Split(m[1], ",") {
+			insertCols = append(insertCols, strings.ToLower(strings.Trim(strings.TrimSpace(col), "`")))
+		}
+	}
+
+	var cols []string
+	var last string
+	values := false
+	count := 0
+	for i := 0; i < len(query); i++ {
+		switch c := query[i]; {
+		case c == '\'' || c == '"':
+			// Skip string literals.
+			if end := strings.IndexByte(query[i+1:], c); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case c == '?':
+			col := last
+			if values && len(insertCols) > 0 {
+				col = insertCols[count%len(insertCols)]
+				count++
+			}
+			cols = append(cols, col)
+		case isIdentChar(c):
+			start := i
+			for i < len(query) && isIdentChar(query[i]) {
+				i++
+			}
+			word := strings.ToLower(strings.Replace(query[start:i], "`", "", -1))
+			i--
+			if dot := strings.LastIndexByte(word, '.'); dot >= 0 {
+				word = word[dot+1:]
+			}
+			switch word {
+			case "binary", "in":
+				// Operators between the column and the placeholder.
+			case "values":
+				values = true
+			case "on", "select":
+				// ON DUPLICATE KEY UPDATE or INSERT ... SELECT.
+				values = false
+				last = word
+			default:
+				last = word
+			}
+		}
+	}
+	return cols
+}
+
+func isIdentChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '.' || c == '`'
+}
+
+type primaryCtxKey struct{}
+
+// WithPrimary returns a context which makes *Ctx methods read from the primary database even when
+// a read replica is configured, e.g. to read back data which has just been written.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryCtxKey{}, true)
+}
+
+// reader returns the connection for read-only queries: the read replica if configured
+// and not overridden by WithPrimary.
+func (a *adapter) reader(ctx context.Context) *sqlx.DB {
+	if a.rdb == nil {
+		return a.db
+	}
+	if primary, _ := ctx.Value(primaryCtxKey{}).(bool); primary {
+		return a.db
+	}
+	return a.rdb
+}
+
 // Close closes the underlying database connection
 func (a *adapter) Close() error {
 	var err error
+	if a.rdb != nil {
+		err = a.rdb.Close()
+		a.rdb = nil
+	}
 	if a.db != nil {
-		err = a.db.Close()
+		if cerr := a.db.Close(); cerr != nil {
+			err = cerr
+		}
 		a.db = nil
 		a.version = -1
 	}
@@ -105,18 +564,128 @@ func (a *adapter) IsOpen() bool {
 	return a.db != nil
 }
 
+// Healthy checks that the database is reachable. Unlike IsOpen it makes a round-trip to the server.
+func (a *adapter) Healthy(ctx context.Context) error {
+	if a.db == nil {
+		return errors.New("mysql adapter is not connected")
+	}
+	return a.db.PingContext(ctx)
+}
+
+// maintainedTables are the tables which accumulate deleted rows and benefit from maintenance.
+var maintainedTables = []string{"users", "usertags", "devices", "auth", "topics", "topictags",
+	"subscriptions", "messages", "dellog", "credentials", "fileuploads", "filemsglinks", "msgreactions"}
+
+// Maintain updates index statistics of the core tables. If optimize is true the tables are also
+// rebuilt to reclaim space left by deleted rows, which may take a long time on large tables.
+// Intended to be called periodically by administrative tools.
+func (a *adapter) Maintain(ctx context.Context, optimize bool) error {
+	if a.db == nil {
+		return errors.New("mysql adapter is not connected")
+	}
+
+	stmt := "ANALYZE TABLE "
+	if optimize {
+		// OPTIMIZE TABLE also updates statistics.
+		stmt = "OPTIMIZE TABLE "
+	}
+	// MySQL reports failures as rows of the result rather than as errors.
+	rows, err := a.db.QueryxContext(ctx, stmt+strings.Join(maintainedTables, ","))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table, op, msgType, msgText string
+		if err = rows.Scan(&table, &op, &msgType, &msgText); err != nil {
+			return err
+		}
+		if msgType == "error" {
+			return errors.New("mysql adapter failed to " + op + " " + table + ": " + msgText)
+		}
+	}
+	return rows.Err()
+}
+
+// DbStats is a summary of the database size.
+type DbStats struct {
+	// Approximate number of rows by table name.
+	Rows map[string]int64
+	// Total size of data and indexes in bytes.
+	Size int64
+}
+
+// DbStats returns approximate row counts and the size of the tables. The numbers are taken from
+// table statistics, which are cheap to read but may be off by a large margin on InnoDB tables.
+func (a *adapter) DbStats(ctx context.Context) (*DbStats, error) {
+	rows, err := a.db.QueryxContext(ctx, "SELECT table_name,COALESCE(table_rows,0),"+
+		"COALESCE(data_length,0)+COALESCE(index_length,0) FROM information_schema.tables WHERE table_schema=?",
+		a.dbName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := &DbStats{Rows: make(map[string]int64)}
+	for rows.Next() {
+		var table string
+		var count, size int64
+		if err = rows.Scan(&table, &count, &size); err != nil {
+			return nil, err
+		}
+		stats.Rows[table] = count
+		stats.Size += size
+	}
+	return stats, rows.Err()
+}
+
+// FileLinkStats reports links between files and messages which point to missing records.
+type FileLinkStats struct {
+	// Links to messages which no longer exist.
+	NoMessage int64
+	// Links to files which no longer exist.
+	NoFile int64
+}
+
+// orphanedLinks maps the referenced table to the column of filemsglinks which refers to it.
+var orphanedLinks = []struct{ table, column string }{{"messages", "msgid"}, {"fileuploads", "fileid"}}
+
+// CheckFileLinks finds file links which point to deleted messages or files. Such links may be
+// left behind by databases created before the foreign keys were added. If clean is true the
+// orphaned links are deleted and the returned stats contain the number of deleted links.
+func (a *adapter) CheckFileLinks(ctx context.Context, clean bool) (*FileLinkStats, error) {
+	counts := make([]int64, len(orphanedLinks))
+	for i, ref := range orphanedLinks {
+		join := "filemsglinks AS fml LEFT JOIN " + ref.table + " AS r ON r.id=fml." + ref.column + " WHERE r.id IS NULL"
+		if !clean {
+			if err := a.db.GetContext(ctx, &counts[i], "SELECT COUNT(*) FROM "+join); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		res, err := a.db.ExecContext(ctx, "DELETE fml.* FROM "+join)
+		if err != nil {
+			return nil, err
+		}
+		if counts[i], err = res.RowsAffected(); err != nil {
+			return nil, err
+		}
+	}
+	return &FileLinkStats{NoMessage: counts[0], NoFile: counts[1]}, nil
+}
+
 // GetDbVersion returns current database version.
 func (a *adapter) GetDbVersion() (int, error) {
 	if a.version > 0 {
 		return a.version, nil
 	}
 
-	var vers int
-	err := a.db.Get(&vers, "SELECT `value` FROM kvmeta WHERE `key`='version'")
+	var value string
+	err := a.db.Get(&value, "SELECT `value` FROM kvmeta WHERE `key`='version'")
+	vers, err := parseDbVersion(value, err)
 	if err != nil {
-		if isMissingDb(err) || err == sql.ErrNoRows {
-			err = errors.New("Database not initialized")
-		}
 		return -1, err
 	}
 
@@ -125,9 +694,28 @@ func (a *adapter) GetDbVersion() (int, error) {
 	return vers, nil
 }
 
-func (a *adapter) updateDbVersion(v int) error {
+// parseDbVersion converts the result of the version query to the version number.
+func parseDbVersion(value string, err error) (int, error) {
+	if err != nil {
+		if isMissingDb(err) {
+			return -1, ErrDbMissing
+		}
+		if err == sql.ErrNoRows || isMissingTable(err) {
+			return -1, ErrDbNotInitialized
+		}
+		return -1, err
+	}
+
+	vers, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return -1, errors.New("mysql adapter: invalid database version '" + value + "'")
+	}
+	return vers, nil
+}
+
+func (a *adapter) updateDbVersion(tx *sqlx.Tx, v int) error {
 	a.version = -1
-	if _, err := a.db.Exec("UPDATE kvmeta SET `value`=? WHERE `key`='version'", v); err != nil {
+	if _, err := tx.Exec("UPDATE kvmeta SET `value`=? WHERE `key`='version'", v); err != nil {
 		return err
 	}
 	return nil
@@ -158,6 +746,48 @@ func (a *adapter) GetName() string {
 	return adapterName
 }
 
+// SetQueryHook registers a callback which is called after each call to TopicsForUser, UsersForTopic,
+// FindUsers and MessageGetAll with the name of the method, its duration and the returned error.
+// Pass nil to remove the hook. It must be set before the adapter is used.
+func (a *adapter) SetQueryHook(hook func(method string, dur time.Duration, err error)) {
+	a.queryHook = hook
+}
+
+func (a *adapter) traceQuery(method string, start time.Time, err error) {
+	if a.queryHook != nil {
+		a.queryHook(method, time.Since(start), err)
+	}
+}
+
+// withRetry calls fn and, if it fails with a transient error, calls it again up to a.maxRetries
+// times with exponential backoff. fn must run a complete transaction so it can be safely repeated.
+func (a *adapter) withRetry(fn func() error) error {
+	backoff := a.retryBackoff
+	err := fn()
+	for i := 0; i < a.maxRetries && isRetryable(err); i++ {
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// withTx runs fn in a transaction. The transaction is committed if fn returns nil,
+// rolled back otherwise.
+func (a *adapter) withTx(fn func(tx *sqlx.Tx) error) error {
+	tx, err := a.db.Beginx()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 // SetMaxResults configures how many results can be returned in a single DB call.
 func (a *adapter) SetMaxResults(val int) error {
 	if val <= 0 {
@@ -170,20 +800,19 @@ func (a *adapter) SetMaxResults(val int) error {
 }
 
 // CreateDb initializes the storage.
-func (a *adapter) CreateDb(reset bool) error {
-	var err error
+// An existing database which contains tables is dropped and recreated only if reset is true.
+func (a *adapter) CreateDb(reset bool) (err error) {
 	var tx *sql.Tx
 
 	// Can't use an existing connection because it's configured with a database name which may not exist.
 	// Don't care if it does not close cleanly.
 	a.db.Close()
 
-	// This DSN has been parsed before and produced no error, not checking for errors here.
-	cfg, _ := ms.ParseDSN(a.dsn)
-	// Clear database name
-	cfg.DBName = ""
-
-	a.db, err = sqlx.Open("mysql", cfg.FormatDSN())
+	dsn, err := serverDSN(a.dsn)
+	if err != nil {
+		return err
+	}
+	a.db, err = sqlx.Open("mysql", dsn)
 	if err != nil {
 		return err
 	}
@@ -192,14 +821,27 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	created := false
 	defer func() {
 		if err != nil {
-			// FIXME: This is useless: MySQL auto-commits on every CREATE TABLE.
-			// Maybe DROP DATABASE instead.
 			tx.Rollback()
+			// MySQL auto-commits on every CREATE TABLE, the rollback does not undo them.
+			// Drop the partially created database instead.
+			if created {
+				if _, derr := a.db.Exec("DROP DATABASE IF EXISTS " + a.dbName); derr != nil {
+					err = errors.New("mysql adapter failed to create database '" + a.dbName + "': " + err.Error() +
+						"; partially created database was not removed: " + derr.Error())
+				} else {
+					err = errors.New("mysql adapter failed to create database '" + a.dbName + "': " + err.Error())
+				}
+			}
 		}
 	}()
 
+	if err = checkCanCreate(tx, a.dbName, reset); err != nil {
+		return err
+	}
+
 	if _, err = tx.Exec("DROP DATABASE IF EXISTS " + a.dbName); err != nil {
 		return err
 	}
@@ -207,11 +849,16 @@ func (a *adapter) CreateDb(reset bool) error {
 	if _, err = tx.Exec("CREATE DATABASE " + a.dbName + " CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci"); err != nil {
 		return err
 	}
+	created = true
 
 	if _, err = tx.Exec("USE " + a.dbName); err != nil {
 		return err
 	}
 
+	// Users. Last seen time and user agent are tracked per user, not per subscription:
+	// lastseen is the time when the user was last online (written by UserUpdate and SubsLastSeen),
+	// useragent is the User-Agent of the session which was last active. Both are reported in
+	// p2p subscriptions by TopicsForUser.
 	if _, err = tx.Exec(
 		`CREATE TABLE users(
 			id        BIGINT NOT NULL,
@@ -271,6 +918,7 @@ func (a *adapter) CreateDb(reset bool) error {
 			authlvl INT NOT NULL,
 			secret  VARCHAR(255) NOT NULL,
 			expires DATETIME,
+			updatedat DATETIME(3),
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX auth_userid_scheme(userid, scheme),
@@ -294,10 +942,13 @@ func (a *adapter) CreateDb(reset bool) error {
 			seqid     INT NOT NULL DEFAULT 0,
 			delid     INT DEFAULT 0,
 			public    JSON,
+			lastmsg   JSON,
 			tags      JSON,
+			pubtext   TEXT,
 			PRIMARY KEY(id),
 			UNIQUE INDEX topics_name(name),
-			INDEX topics_owner(owner)
+			INDEX topics_owner_deletedat(owner, deletedat),
+			FULLTEXT INDEX topics_pubtext(pubtext)
 		)`); err != nil {
 		return err
 	}
@@ -334,7 +985,9 @@ func (a *adapter) CreateDb(reset bool) error {
 			PRIMARY KEY(id),
 			FOREIGN KEY(userid) REFERENCES users(id),
 			UNIQUE INDEX subscriptions_topic_userid(topic, userid),
-			INDEX subscriptions_topic(topic)
+			INDEX subscriptions_topic_deletedat(topic, deletedat),
+			INDEX subscriptions_userid_topic(userid, topic),
+			INDEX subscriptions_updatedat(updatedat)
 		)`); err != nil {
 		return err
 	}
@@ -429,6 +1082,21 @@ func (a *adapter) CreateDb(reset bool) error {
 		return err
 	}
 
+	// Reactions to messages.
+	if _, err = tx.Exec("CREATE TABLE " + msgReactionsTable); err != nil {
+		return err
+	}
+
+	// Outbox of saved messages.
+	if _, err = tx.Exec("CREATE TABLE " + msgOutboxTable); err != nil {
+		return err
+	}
+
+	// Prior versions of edited messages.
+	if _, err = tx.Exec("CREATE TABLE " + msgEditsTable); err != nil {
+		return err
+	}
+
 	if _, err = tx.Exec(
 		`CREATE TABLE kvmeta(` +
 			"`key`   CHAR(32)," +
@@ -444,28 +1112,99 @@ func (a *adapter) CreateDb(reset bool) error {
 	return tx.Commit()
 }
 
-func (a *adapter) UpgradeDb() error {
-	if _, err := a.GetDbVersion(); err != nil {
-		return err
+// checkCanCreate fails if the database exists and has tables, unless reset is requested.
+func checkCanCreate(db interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}, dbName string, reset bool) error {
+	if reset {
+		return nil
 	}
 
-	if a.version == 106 {
-		// Perform database upgrade from version 106 to version 107.
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=?",
+		dbName).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return errors.New("mysql adapter: database '" + dbName + "' already exists and is not empty, " +
+			"use reset to drop and recreate it")
+	}
+	return nil
+}
 
-		if _, err := a.db.Exec("CREATE UNIQUE INDEX usertags_userid_tag ON usertags(userid, tag)"); err != nil {
-			return err
-		}
+// msgReactionsTable is the definition of the table of reactions to messages. Each user may leave
+// a given reaction on a message only once.
+const msgReactionsTable = `msgreactions(
+			id			INT NOT NULL AUTO_INCREMENT,
+			createdat	DATETIME(3) NOT NULL,
+			msgid		INT NOT NULL,
+			userid		BIGINT NOT NULL,
+			reaction	VARCHAR(32) NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+			FOREIGN KEY(userid) REFERENCES users(id) ON DELETE CASCADE,
+			UNIQUE INDEX msgreactions_msgid_userid_reaction(msgid, userid, reaction)
+		)`
+
+// msgOutboxTable is the definition of the outbox table: IDs of saved messages which have not been
+// picked up by the relay yet.
+const msgOutboxTable = `msgoutbox(
+			id			INT NOT NULL AUTO_INCREMENT,
+			createdat	DATETIME(3) NOT NULL,
+			msgid		INT NOT NULL,
+			PRIMARY KEY(id),
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+			UNIQUE INDEX msgoutbox_msgid(msgid)
+		)`
 
-		if _, err := a.db.Exec("CREATE UNIQUE INDEX topictags_userid_tag ON topictags(topic, tag)"); err != nil {
-			return err
-		}
+// msgEditsTable is the definition of the table of prior versions of edited messages.
+const msgEditsTable = `msgedits(
+			id			INT NOT NULL AUTO_INCREMENT,
+			createdat	DATETIME(3) NOT NULL,
+			msgid		INT NOT NULL,
+			head		JSON,
+			content		JSON,
+			PRIMARY KEY(id),
+			FOREIGN KEY(msgid) REFERENCES messages(id) ON DELETE CASCADE,
+			INDEX msgedits_msgid(msgid)
+		)`
+
+// dbUpgrades is a list of database upgrade steps ordered by version. Each step upgrades the
+// database from version 'from' to version 'from+1'.
+var dbUpgrades = []struct {
+	from    int
+	upgrade func(tx *sqlx.Tx) error
+}{
+	{106, upgradeFrom106},
+	{107, upgradeFrom107},
+	{108, upgradeFrom108},
+	{109, upgradeFrom109},
+	{110, upgradeFrom110},
+	{111, upgradeFrom111},
+	{112, upgradeFrom112},
+	{113, upgradeFrom113},
+	{114, upgradeFrom114},
+	{115, upgradeFrom115},
+	{116, upgradeFrom116},
+}
 
-		if _, err := a.db.Exec("ALTER TABLE credentials ADD deletedat DATETIME(3) AFTER updatedat"); err != nil {
-			return err
+// UpgradeDb upgrades the database to the current adapter version by applying upgrade steps one by one.
+// A failed step cannot be rolled back cleanly: MySQL commits DDL statements implicitly, so the schema
+// changes made before the failure remain while the version is not bumped. Every step is safe to re-run
+// against such a half-applied schema, i.e. the upgrade can be retried once the cause is fixed.
+func (a *adapter) UpgradeDb() error {
+	if _, err := a.GetDbVersion(); err != nil {
+		return err
+	}
+
+	for _, step := range dbUpgrades {
+		if a.version != step.from {
+			continue
 		}
 
-		if err := a.updateDbVersion(107); err != nil {
-			return err
+		if err := a.upgradeStep(step.from, step.upgrade); err != nil {
+			return errors.New("Database upgrade from version " + strconv.Itoa(step.from) +
+				" failed: " + err.Error())
 		}
 
 		if _, err := a.GetDbVersion(); err != nil {
@@ -473,52 +1212,208 @@ func (a *adapter) UpgradeDb() error {
 		}
 	}
 
-	if a.version == 107 {
-		// Perform database upgrade from version 107 to version 108.
+	if a.version != adpVersion {
+		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
+			". DB is still at " + strconv.Itoa(a.version))
+	}
+	return nil
+}
 
-		// Replace default user access JRWPA with JRWPAS.
-		if _, err := a.db.Exec(`UPDATE users SET access=JSON_REPLACE(access, '$.Auth', 'JRWPAS') 
-			WHERE CAST(JSON_EXTRACT(access, '$.Auth') AS CHAR) LIKE '"JRWPA"'`); err != nil {
+// upgradeStep runs a single upgrade step and bumps the version in one transaction.
+// MySQL commits DDL statements implicitly, so steps must be safe to re-run after a failure.
+func (a *adapter) upgradeStep(from int, upgrade func(tx *sqlx.Tx) error) error {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		if err := upgrade(tx); err != nil {
 			return err
 		}
 
-		if err := a.updateDbVersion(108); err != nil {
-			return err
-		}
+		return a.updateDbVersion(tx, from+1)
+	})
+}
 
-		if _, err := a.GetDbVersion(); err != nil {
+// Upgrade from version 106 to version 107.
+func upgradeFrom106(tx *sqlx.Tx) error {
+	if err := createIndex(tx, "usertags", "usertags_userid_tag",
+		"CREATE UNIQUE INDEX usertags_userid_tag ON usertags(userid, tag)"); err != nil {
+		return err
+	}
+
+	if err := createIndex(tx, "topictags", "topictags_userid_tag",
+		"CREATE UNIQUE INDEX topictags_userid_tag ON topictags(topic, tag)"); err != nil {
+		return err
+	}
+
+	return addColumn(tx, "credentials", "deletedat",
+		"ALTER TABLE credentials ADD deletedat DATETIME(3) AFTER updatedat")
+}
+
+// Upgrade from version 107 to version 108.
+func upgradeFrom107(tx *sqlx.Tx) error {
+	// Replace default user access JRWPA with JRWPAS.
+	_, err := tx.Exec(`UPDATE users SET access=JSON_REPLACE(access, '$.Auth', 'JRWPAS') 
+		WHERE CAST(JSON_EXTRACT(access, '$.Auth') AS CHAR) LIKE '"JRWPA"'`)
+	return err
+}
+
+// Upgrade from version 108 to version 109.
+func upgradeFrom108(tx *sqlx.Tx) error {
+	// Full-text index of topics' public data.
+	if err := addColumn(tx, "topics", "pubtext", "ALTER TABLE topics ADD pubtext TEXT AFTER tags"); err != nil {
+		return err
+	}
+	if err := createIndex(tx, "topics", "topics_pubtext",
+		"CREATE FULLTEXT INDEX topics_pubtext ON topics(pubtext)"); err != nil {
+		return err
+	}
+
+	var topics []struct {
+		Name   string
+		Public []byte
+	}
+	if err := tx.Select(&topics, "SELECT name,public FROM topics WHERE public IS NOT NULL"); err != nil {
+		return err
+	}
+	for _, top := range topics {
+		if _, err := tx.Exec("UPDATE topics SET pubtext=? WHERE name=?",
+			publicText(fromJSON(top.Public)), top.Name); err != nil {
 			return err
 		}
 	}
+	return nil
+}
 
-	if a.version != adpVersion {
-		return errors.New("Failed to perform database upgrade to version " + strconv.Itoa(adpVersion) +
-			". DB is still at " + strconv.Itoa(a.version))
+// Upgrade from version 109 to version 110.
+func upgradeFrom109(tx *sqlx.Tx) error {
+	// Reactions to messages.
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + msgReactionsTable)
+	return err
+}
+
+// Upgrade from version 110 to version 111.
+func upgradeFrom110(tx *sqlx.Tx) error {
+	// Time when the auth secret was last changed. Unknown for existing records.
+	return addColumn(tx, "auth", "updatedat", "ALTER TABLE auth ADD updatedat DATETIME(3) AFTER expires")
+}
+
+// Upgrade from version 111 to version 112.
+func upgradeFrom111(tx *sqlx.Tx) error {
+	// Outbox of saved messages.
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + msgOutboxTable)
+	return err
+}
+
+// Upgrade from version 112 to version 113.
+func upgradeFrom112(tx *sqlx.Tx) error {
+	// Filtering user's subscriptions by topic category.
+	return createIndex(tx, "subscriptions", "subscriptions_userid_topic",
+		"CREATE INDEX subscriptions_userid_topic ON subscriptions(userid, topic)")
+}
+
+// Upgrade from version 113 to version 114.
+func upgradeFrom113(tx *sqlx.Tx) error {
+	// MySQL has no partial indexes. Indexes with deletedat as the last column are used instead
+	// for lookups of rows which are not deleted: 'deletedat IS NULL' is resolved from the index.
+	if err := createIndex(tx, "topics", "topics_owner_deletedat",
+		"CREATE INDEX topics_owner_deletedat ON topics(owner, deletedat)"); err != nil {
+		return err
 	}
-	return nil
+	if err := dropIndex(tx, "topics", "topics_owner"); err != nil {
+		return err
+	}
+	if err := createIndex(tx, "subscriptions", "subscriptions_topic_deletedat",
+		"CREATE INDEX subscriptions_topic_deletedat ON subscriptions(topic, deletedat)"); err != nil {
+		return err
+	}
+	return dropIndex(tx, "subscriptions", "subscriptions_topic")
 }
 
-func addTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string, ignoreDups bool) error {
+// Upgrade from version 114 to version 115.
+func upgradeFrom114(tx *sqlx.Tx) error {
+	// Fetching subscriptions modified since a given time.
+	return createIndex(tx, "subscriptions", "subscriptions_updatedat",
+		"CREATE INDEX subscriptions_updatedat ON subscriptions(updatedat)")
+}
 
-	if len(tags) == 0 {
+// Upgrade from version 115 to version 116.
+func upgradeFrom115(tx *sqlx.Tx) error {
+	// Preview of the last message. Empty for existing topics until the next message.
+	return addColumn(tx, "topics", "lastmsg", "ALTER TABLE topics ADD lastmsg JSON AFTER public")
+}
+
+// Upgrade from version 116 to version 117.
+func upgradeFrom116(tx *sqlx.Tx) error {
+	// Prior versions of edited messages.
+	_, err := tx.Exec("CREATE TABLE IF NOT EXISTS " + msgEditsTable)
+	return err
+}
+
+// addColumn executes the ALTER TABLE statement unless the column already exists.
+func addColumn(tx *sqlx.Tx, table, column, alter string) error {
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM information_schema.columns "+
+		"WHERE table_schema=DATABASE() AND table_name=? AND column_name=?", table, column); err != nil {
+		return err
+	}
+	if count > 0 {
 		return nil
 	}
+	_, err := tx.Exec(alter)
+	return err
+}
 
-	var insert *sql.Stmt
-	var err error
-	insert, err = tx.Prepare("INSERT INTO " + table + "(" + keyName + ",tag) VALUES(?,?)")
+// createIndex executes the CREATE INDEX statement unless the index already exists.
+func createIndex(tx *sqlx.Tx, table, index, create string) error {
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM information_schema.statistics "+
+		"WHERE table_schema=DATABASE() AND table_name=? AND index_name=?", table, index); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := tx.Exec(create)
+	return err
+}
+
+// dropIndex drops the index if it exists.
+func dropIndex(tx *sqlx.Tx, table, index string) error {
+	var count int
+	if err := tx.Get(&count, "SELECT COUNT(*) FROM information_schema.statistics "+
+		"WHERE table_schema=DATABASE() AND table_name=? AND index_name=?", table, index); err != nil {
+		return err
+	}
+	if count == 0 {
+		return nil
+	}
+	_, err := tx.Exec("DROP INDEX " + index + " ON " + table)
+	return err
+}
+
+// addTags saves normalized tags to the table. Returns t.ErrMalformed if any tag is empty or too long.
+func addTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string, ignoreDups bool) error {
+	tags, err := normalizeTags(tags)
 	if err != nil {
 		return err
 	}
+	if len(tags) == 0 {
+		return nil
+	}
 
-	for _, tag := range tags {
-		_, err = insert.Exec(keyVal, tag)
+	// Two placeholders per row.
+	batchSize := maxInBatchSize / 2
+	for len(tags) > 0 {
+		batch := tags
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		tags = tags[len(batch):]
 
-		if err != nil {
+		args := make([]interface{}, 0, len(batch)*2)
+		for _, tag := range batch {
+			args = append(args, keyVal, tag)
+		}
+		if _, err := tx.Exec(addTagsQuery(table, keyName, len(batch), ignoreDups), args...); err != nil {
 			if isDupe(err) {
-				if ignoreDups {
-					continue
-				}
 				return t.ErrDuplicate
 			}
 			return err
@@ -528,6 +1423,35 @@ func addTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []stri
 	return nil
 }
 
+// normalizeTags trims whitespace and converts tags to lowercase, same as the server does, then removes
+// duplicates keeping the order. Returns t.ErrMalformed if a tag is empty or longer than maxTagLength.
+func normalizeTags(tags []string) ([]string, error) {
+	seen := make(map[string]bool, len(tags))
+	out := make([]string, 0, len(tags))
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, t.ErrMalformed
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			out = append(out, tag)
+		}
+	}
+	return out, nil
+}
+
+// addTagsQuery builds a multi-row INSERT of count tags. If ignoreDups is true, tags which
+// already exist are left unchanged instead of failing the statement.
+func addTagsQuery(table, keyName string, count int, ignoreDups bool) string {
+	query := "INSERT INTO " + table + "(" + keyName + ",tag) VALUES(?,?)" +
+		strings.Repeat(",(?,?)", count-1)
+	if ignoreDups {
+		query += " ON DUPLICATE KEY UPDATE tag=tag"
+	}
+	return query
+}
+
 func removeTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []string) error {
 	if len(tags) == 0 {
 		return nil
@@ -535,7 +1459,8 @@ func removeTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []s
 
 	var args []interface{}
 	for _, tag := range tags {
-		args = append(args, tag)
+		// Tags are stored normalized.
+		args = append(args, strings.ToLower(strings.TrimSpace(tag)))
 	}
 
 	query, args, _ := sqlx.In("DELETE FROM "+table+" WHERE "+keyName+"=? AND tag IN (?)", keyVal, args)
@@ -548,43 +1473,30 @@ func removeTags(tx *sqlx.Tx, table, keyName string, keyVal interface{}, tags []s
 // UserCreate creates a new user. Returns error and true if error is due to duplicate user name,
 // false for any other error
 func (a *adapter) UserCreate(user *t.User) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		jpub, err := toJSON(user.Public)
 		if err != nil {
-			tx.Rollback()
+			return err
+		}
+		decoded_uid := store.DecodeUid(user.Uid())
+		if _, err := tx.Exec("INSERT INTO users(id,createdat,updatedat,access,public,tags) VALUES(?,?,?,?,?,?)",
+			decoded_uid,
+			user.CreatedAt, user.UpdatedAt,
+			user.Access, jpub, user.Tags); err != nil {
+			return err
 		}
-	}()
-
-	decoded_uid := store.DecodeUid(user.Uid())
-	if _, err = tx.Exec("INSERT INTO users(id,createdat,updatedat,access,public,tags) VALUES(?,?,?,?,?,?)",
-		decoded_uid,
-		user.CreatedAt, user.UpdatedAt,
-		user.Access, toJSON(user.Public), user.Tags); err != nil {
-		return err
-	}
-
-	// Save user's tags to a separate table to make user findable.
-	if err = addTags(tx, "usertags", "userid", decoded_uid, user.Tags, false); err != nil {
-		return err
-	}
 
-	return tx.Commit()
+		// Save user's tags to a separate table to make user findable.
+		return addTags(tx, "usertags", "userid", decoded_uid, user.Tags, false)
+	})
 }
 
 // Add user's authentication record
 func (a *adapter) AuthAddRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
 	secret []byte, expires time.Time) (bool, error) {
 
-	var exp *time.Time
-	if !expires.IsZero() {
-		exp = &expires
-	}
-	_, err := a.db.Exec("INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires) VALUES(?,?,?,?,?,?)",
-		unique, store.DecodeUid(uid), scheme, authLvl, secret, exp)
+	_, err := a.db.Exec("INSERT INTO auth(uname,userid,scheme,authLvl,secret,expires,updatedat) VALUES(?,?,?,?,?,?,?)",
+		unique, store.DecodeUid(uid), scheme, authLvl, secret, expiresToDb(expires), t.TimeNow())
 	if err != nil {
 		if isDupe(err) {
 			return true, t.ErrDuplicate
@@ -614,13 +1526,11 @@ func (a *adapter) AuthDelAllRecords(user t.Uid) (int, error) {
 // Update user's authentication secret
 func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.Level,
 	secret []byte, expires time.Time) (bool, error) {
-	var exp *time.Time
-	if !expires.IsZero() {
-		exp = &expires
-	}
-
-	_, err := a.db.Exec("UPDATE auth SET uname=?,authLvl=?,secret=?,expires=? WHERE uname=?",
-		unique, authLvl, secret, exp, unique)
+	// The updatedat is changed only if the secret is changed. It must be assigned before the secret:
+	// MySQL evaluates assignments left to right using the updated values.
+	_, err := a.db.Exec("UPDATE auth SET updatedat=IF(BINARY secret=BINARY ?,updatedat,?),uname=?,authLvl=?,secret=?,expires=? "+
+		"WHERE userid=? AND scheme=?",
+		secret, t.TimeNow(), unique, authLvl, secret, expiresToDb(expires), store.DecodeUid(uid), scheme)
 	if isDupe(err) {
 		return true, t.ErrDuplicate
 	}
@@ -628,63 +1538,107 @@ func (a *adapter) AuthUpdRecord(uid t.Uid, scheme, unique string, authLvl auth.L
 	return false, err
 }
 
-// Retrieve user's authentication record
-func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
-	var expires time.Time
+// AuthGetRecordMeta returns the time when the secret of the user's authentication record was last changed.
+// Zero time is returned if the record does not exist or the time is unknown.
+func (a *adapter) AuthGetRecordMeta(uid t.Uid, scheme string) (time.Time, error) {
+	var updatedAt *time.Time
+	err := a.db.Get(&updatedAt, "SELECT updatedat FROM auth WHERE userid=? AND scheme=?", store.DecodeUid(uid), scheme)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			// Nothing found - clear the error
+			err = nil
+		}
+		return time.Time{}, err
+	}
+	if updatedAt == nil {
+		return time.Time{}, nil
+	}
+	return *updatedAt, nil
+}
+
+// authRecord is a row of the auth table. Columns are mapped explicitly so the scan
+// does not depend on how the driver reports column names.
+type authRecord struct {
+	Uname   string     `db:"uname"`
+	Userid  int64      `db:"userid"`
+	Authlvl auth.Level `db:"authlvl"`
+	Secret  []byte     `db:"secret"`
+	Expires *time.Time `db:"expires"`
+}
+
+// Auth records which never expire have zero expiration time, as expected by the authenticators.
+// Such records are stored with NULL expires.
 
-	var record struct {
-		Uname   string
-		Authlvl auth.Level
-		Secret  []byte
-		Expires *time.Time
+// expiresToDb converts expiration time to the value of the expires column.
+func expiresToDb(expires time.Time) *time.Time {
+	if expires.IsZero() {
+		return nil
+	}
+	return &expires
+}
+
+// expiresTime returns expiration time of the record or zero time if the record never expires.
+func (r *authRecord) expiresTime() time.Time {
+	if r.Expires == nil {
+		return time.Time{}
 	}
+	return *r.Expires
+}
 
+// Retrieve user's authentication record
+func (a *adapter) AuthGetRecord(uid t.Uid, scheme string) (string, auth.Level, []byte, time.Time, error) {
+	var record authRecord
 	if err := a.db.Get(&record, "SELECT uname,secret,expires,authlvl FROM auth WHERE userid=? AND scheme=?",
 		store.DecodeUid(uid), scheme); err != nil {
 		if err == sql.ErrNoRows {
 			// Nothing found - clear the error
 			err = nil
 		}
-		return "", 0, nil, expires, err
-	}
-
-	if record.Expires != nil {
-		expires = *record.Expires
+		return "", 0, nil, time.Time{}, err
 	}
 
-	return record.Uname, record.Authlvl, record.Secret, expires, nil
+	return record.Uname, record.Authlvl, record.Secret, record.expiresTime(), nil
 }
 
 // Retrieve user's authentication record
 func (a *adapter) AuthGetUniqueRecord(unique string) (t.Uid, auth.Level, []byte, time.Time, error) {
-	var expires time.Time
-
-	var record struct {
-		Userid  int64
-		Authlvl auth.Level
-		Secret  []byte
-		Expires *time.Time
-	}
-
+	var record authRecord
 	if err := a.db.Get(&record, "SELECT userid,secret,expires,authlvl FROM auth WHERE uname=?", unique); err != nil {
 		if err == sql.ErrNoRows {
 			// Nothing found - clear the error
 			err = nil
 		}
-		return t.ZeroUid, 0, nil, expires, err
+		return t.ZeroUid, 0, nil, time.Time{}, err
 	}
 
-	if record.Expires != nil {
-		expires = *record.Expires
-	}
-
-	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, expires, nil
+	return store.EncodeUid(record.Userid), record.Authlvl, record.Secret, record.expiresTime(), nil
 }
 
-// UserGet fetches a single user by user id. If user is not found it returns (nil, nil)
+// UserGet fetches a single user by user id. If user is not found it returns (nil, nil).
+// Users which are not in t.StateOK, e.g. suspended, are treated as not found.
 func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
+	return a.userGet(context.Background(), uid, false)
+}
+
+// UserGetCtx is the same as UserGet but the query can be cancelled or timed out by ctx.
+func (a *adapter) UserGetCtx(ctx context.Context, uid t.Uid) (*t.User, error) {
+	return a.userGet(ctx, uid, false)
+}
+
+// UserGetAnyState is the same as UserGet but also returns suspended users. Intended for
+// administrative tools.
+func (a *adapter) UserGetAnyState(uid t.Uid) (*t.User, error) {
+	return a.userGet(context.Background(), uid, true)
+}
+
+func (a *adapter) userGet(ctx context.Context, uid t.Uid, anyState bool) (*t.User, error) {
+	q := "SELECT * FROM users WHERE id=? AND deletedat IS NULL"
+	if !anyState {
+		q += " AND state=" + strconv.Itoa(t.StateOK)
+	}
+
 	var user t.User
-	err := a.db.Get(&user, "SELECT * FROM users WHERE id=? AND deletedat IS NULL", store.DecodeUid(uid))
+	err := a.db.GetContext(ctx, &user, q, store.DecodeUid(uid))
 	if err == nil {
 		user.SetUid(uid)
 		user.Public = fromJSON(user.Public)
@@ -700,150 +1654,194 @@ func (a *adapter) UserGet(uid t.Uid) (*t.User, error) {
 	return nil, err
 }
 
+// UserGetAll loads users with the given IDs. Users which are soft-deleted or not in t.StateOK,
+// e.g. suspended, are skipped.
 func (a *adapter) UserGetAll(ids ...t.Uid) ([]t.User, error) {
-	uids := make([]interface{}, len(ids))
-	for i, id := range ids {
-		uids[i] = store.DecodeUid(id)
-	}
+	return a.userGetAll("*", true, ids)
+}
 
-	users := []t.User{}
-	q, uids, _ := sqlx.In("SELECT * FROM users WHERE id IN (?) AND deletedat IS NULL", uids)
-	q = a.db.Rebind(q)
-	rows, err := a.db.Queryx(q, uids...)
-	if err != nil {
-		return nil, err
-	}
+// UserGetAllAnyState is the same as UserGetAll but also returns suspended users. Intended for
+// administrative tools.
+func (a *adapter) UserGetAllAnyState(ids ...t.Uid) ([]t.User, error) {
+	return a.userGetAll("*", false, ids)
+}
 
-	var user t.User
-	for rows.Next() {
-		if err = rows.StructScan(&user); err != nil {
-			users = nil
-			break
+// UserGetAllSlim is the same as UserGetAllAnyState but only loads the IDs, timestamps and states
+// of users. Public, tags and other heavy fields are not loaded. Useful for membership and presence
+// checks: the caller decides how to treat suspended users.
+func (a *adapter) UserGetAllSlim(ids ...t.Uid) ([]t.User, error) {
+	return a.userGetAll("id,createdat,updatedat,deletedat,state", false, ids)
+}
+
+// userGetAll loads the given columns of users with the given IDs. If activeOnly is true,
+// only users in t.StateOK are loaded.
+func (a *adapter) userGetAll(cols string, activeOnly bool, ids []t.Uid) ([]t.User, error) {
+	where := " AND deletedat IS NULL"
+	if activeOnly {
+		where += " AND state=" + strconv.Itoa(t.StateOK)
+	}
+
+	// Skip duplicate ids: otherwise a user could be returned more than once if the copies
+	// end up in different batches.
+	seen := make(map[t.Uid]bool, len(ids))
+	uids := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			uids = append(uids, store.DecodeUid(id))
 		}
+	}
 
-		if user.DeletedAt != nil {
-			continue
+	users := []t.User{}
+	// Fetch users in batches to stay within the limit on the number of placeholders.
+	for _, batch := range chunkArgs(uids, a.inBatchSize) {
+		q, batch, _ := sqlx.In("SELECT "+cols+" FROM users WHERE id IN (?)"+where, batch)
+		q = a.db.Rebind(q)
+		rows, err := a.db.Queryx(q, batch...)
+		if err != nil {
+			return nil, err
 		}
 
-		user.SetUid(encodeUidString(user.Id))
-		user.Public = fromJSON(user.Public)
+		for rows.Next() {
+			var user t.User
+			if err = rows.StructScan(&user); err != nil {
+				break
+			}
+
+			if user.DeletedAt != nil {
+				continue
+			}
 
-		users = append(users, user)
+			user.SetUid(encodeUidString(user.Id))
+			user.Public = fromJSON(user.Public)
+
+			users = append(users, user)
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
 	}
-	rows.Close()
 
-	return users, err
+	return users, nil
 }
 
 // UserDelete deletes specified user: wipes completely (hard-delete) or marks as deleted.
-// TODO: report when the user is not found.
+// Returns t.ErrNotFound if the user does not exist. Soft-deleting a user which is already
+// soft-deleted is a no-op.
 func (a *adapter) UserDelete(uid t.Uid, hard bool) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+	return a.withTx(func(tx *sqlx.Tx) error {
+		var err error
 
-	decoded_uid := store.DecodeUid(uid)
+		decoded_uid := store.DecodeUid(uid)
 
-	if hard {
-		// Delete user's devices
-		if err = deviceDelete(tx, uid, ""); err != nil {
+		var deletedAt *time.Time
+		if err = tx.Get(&deletedAt, "SELECT deletedat FROM users WHERE id=? FOR UPDATE", decoded_uid); err != nil {
+			if err == sql.ErrNoRows {
+				err = t.ErrNotFound
+			}
 			return err
 		}
-
-		// Delete user's subscriptions in all topics.
-		if err = subsDelForUser(tx, uid, true); err != nil {
-			return err
+		if !hard && deletedAt != nil {
+			// Already soft-deleted, nothing to do.
+			return nil
 		}
 
-		// Delete records of messages soft-deleted for the user.
-		if _, err = tx.Exec("DELETE FROM dellog WHERE deletedfor=?", decoded_uid); err != nil {
-			return err
-		}
+		if hard {
+			// Delete user's devices
+			if err = deviceDelete(tx, uid, ""); err != nil {
+				return err
+			}
 
-		// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
-		// Just leave the messages there marked as sent by "not found" user.
+			// Delete user's subscriptions in all topics.
+			if err = subsDelForUser(tx, uid, true); err != nil {
+				return err
+			}
 
-		// Delete topics where the user is the owner.
+			// Delete records of messages soft-deleted for the user.
+			if _, err = tx.Exec("DELETE FROM dellog WHERE deletedfor=?", decoded_uid); err != nil {
+				return err
+			}
 
-		// First delete all messages in those topics.
-		if _, err = tx.Exec("DELETE dellog FROM dellog LEFT JOIN topics ON topics.name=dellog.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
-			return err
-		}
-		if _, err = tx.Exec("DELETE messages FROM messages LEFT JOIN topics ON topics.name=messages.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
-			return err
-		}
+			// Can't delete user's messages in all topics because we cannot notify topics of such deletion.
+			// Just leave the messages there marked as sent by "not found" user.
 
-		// Delete all subscriptions.
-		if _, err = tx.Exec("DELETE sub FROM subscriptions AS sub LEFT JOIN topics ON topics.name=sub.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
-			return err
-		}
+			// Delete topics where the user is the owner.
 
-		// Delete topic tags
-		if _, err = tx.Exec("DELETE topictags FROM topictags LEFT JOIN topics ON topics.name=topictags.topic WHERE topics.owner=?",
-			decoded_uid); err != nil {
-			return err
-		}
+			// First delete all messages in those topics.
+			if _, err = tx.Exec("DELETE dellog FROM dellog LEFT JOIN topics ON topics.name=dellog.topic WHERE topics.owner=?",
+				decoded_uid); err != nil {
+				return err
+			}
+			if _, err = tx.Exec("DELETE messages FROM messages LEFT JOIN topics ON topics.name=messages.topic WHERE topics.owner=?",
+				decoded_uid); err != nil {
+				return err
+			}
 
-		// And finally delete the topics.
-		if _, err = tx.Exec("DELETE FROM topics WHERE owner=?", decoded_uid); err != nil {
-			return err
-		}
+			// Delete all subscriptions.
+			if _, err = tx.Exec("DELETE sub FROM subscriptions AS sub LEFT JOIN topics ON topics.name=sub.topic WHERE topics.owner=?",
+				decoded_uid); err != nil {
+				return err
+			}
 
-		// Delete user's authentication records.
-		if _, err = tx.Exec("DELETE FROM auth WHERE userid=?", decoded_uid); err != nil {
-			return err
-		}
+			// Delete topic tags
+			if _, err = tx.Exec("DELETE topictags FROM topictags LEFT JOIN topics ON topics.name=topictags.topic WHERE topics.owner=?",
+				decoded_uid); err != nil {
+				return err
+			}
 
-		// Delete all credentials.
-		if err = credDel(tx, uid, "", ""); err != nil {
-			return err
-		}
+			// And finally delete the topics.
+			if _, err = tx.Exec("DELETE FROM topics WHERE owner=?", decoded_uid); err != nil {
+				return err
+			}
 
-		if _, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
-			return err
-		}
+			// Delete user's authentication records.
+			if _, err = tx.Exec("DELETE FROM auth WHERE userid=?", decoded_uid); err != nil {
+				return err
+			}
 
-		if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
-			return err
-		}
-	} else {
-		now := t.TimeNow()
-		// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
-		if err = subsDelForUser(tx, uid, false); err != nil {
-			return err
-		}
+			// Delete all credentials.
+			if _, err = credDel(tx, uid, "", ""); err != nil {
+				return err
+			}
 
-		// TODO: Disable all p2p subscriptions with the user.
+			if _, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
+				return err
+			}
 
-		// Disable all subscriptions to topics where the user is the owner.
-		if _, err = tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
-			"SET subscriptions.updatedAt=?, subscriptions.deletedAt=? WHERE topics.owner=?",
-			now, now, decoded_uid); err != nil {
-			return err
-		}
-		// Disable all topics where the user is the owner.
-		if _, err = tx.Exec("UPDATE topics SET updatedAt=?, deletedAt=? WHERE owner=?",
-			now, now, decoded_uid); err != nil {
-			return err
-		}
+			if _, err = tx.Exec("DELETE FROM users WHERE id=?", decoded_uid); err != nil {
+				return err
+			}
+		} else {
+			now := t.TimeNow()
+			// Disable all user's subscriptions. That includes p2p subscriptions. No need to delete them.
+			if err = subsDelForUser(tx, uid, false); err != nil {
+				return err
+			}
 
-		// Disable user.
-		if _, err = tx.Exec("UPDATE users SET updatedAt=?, deletedAt=? WHERE id=?", now, now, decoded_uid); err != nil {
-			return err
+			// TODO: Disable all p2p subscriptions with the user.
+
+			// Disable all subscriptions to topics where the user is the owner.
+			if _, err = tx.Exec("UPDATE subscriptions LEFT JOIN topics ON subscriptions.topic=topics.name "+
+				"SET subscriptions.updatedAt=?, subscriptions.deletedAt=? WHERE topics.owner=?",
+				now, now, decoded_uid); err != nil {
+				return err
+			}
+			// Disable all topics where the user is the owner.
+			if _, err = tx.Exec("UPDATE topics SET updatedAt=?, deletedAt=? WHERE owner=?",
+				now, now, decoded_uid); err != nil {
+				return err
+			}
+
+			// Disable user.
+			if _, err = tx.Exec("UPDATE users SET updatedAt=?, deletedAt=? WHERE id=?", now, now, decoded_uid); err != nil {
+				return err
+			}
 		}
-	}
 
-	return tx.Commit()
+		return nil
+	})
 }
 
 func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
@@ -866,94 +1864,160 @@ func (a *adapter) UserGetDisabled(since time.Time) ([]t.Uid, error) {
 	return uids, err
 }
 
-// UserUpdate updates user object.
-func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
-	tx, err := a.db.Beginx()
+// UserGetUnvalidated returns IDs of users who have credentials but none of them are confirmed, and
+// who were created before lastActive. Users without credentials are not returned. Used to find
+// abandoned registrations.
+func (a *adapter) UserGetUnvalidated(lastActive time.Time, limit int) ([]t.Uid, error) {
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+
+	rows, err := a.db.Queryx("SELECT u.id FROM users AS u JOIN credentials AS c ON c.userid=u.id "+
+		"WHERE u.createdat<? AND u.deletedat IS NULL AND c.deletedat IS NULL "+
+		"GROUP BY u.id HAVING SUM(c.done)=0 ORDER BY u.id LIMIT ?", lastActive, limit)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	var uids []t.Uid
+	for rows.Next() {
+		var userId int64
+		if err = rows.Scan(&userId); err != nil {
+			uids = nil
+			break
 		}
-	}()
+		uids = append(uids, store.EncodeUid(userId))
+	}
+	rows.Close()
 
-	cols, args := updateByMap(update)
-	decoded_uid := store.DecodeUid(uid)
-	args = append(args, decoded_uid)
+	return uids, err
+}
 
-	_, err = tx.Exec("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=?", args...)
-	if err != nil {
-		return err
-	}
+// UserUpdate updates user object.
+func (a *adapter) UserUpdate(uid t.Uid, update map[string]interface{}) error {
+	return a.withRetry(func() error {
+		return a.userUpdate(uid, nil, update)
+	})
+}
+
+// UserUpdateIfUnmodified is the same as UserUpdate but the update is applied only if the user record
+// was last updated at expectedUpdatedAt. Returns t.ErrConflict if the record was modified in the meantime,
+// t.ErrNotFound if the user does not exist.
+func (a *adapter) UserUpdateIfUnmodified(uid t.Uid, expectedUpdatedAt time.Time, update map[string]interface{}) error {
+	return a.withRetry(func() error {
+		return a.userUpdate(uid, &expectedUpdatedAt, update)
+	})
+}
 
-	// Tags are also stored in a separate table
-	if tags := extractTags(update); tags != nil {
-		// First delete all user tags
-		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+// userUpdate updates the user record. If expectedUpdatedAt is not nil, the record is updated only if
+// its updatedat matches.
+func (a *adapter) userUpdate(uid t.Uid, expectedUpdatedAt *time.Time, update map[string]interface{}) error {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		cols, args, err := updateByMap("users", update)
 		if err != nil {
 			return err
 		}
-		// Now insert new tags
-		err = addTags(tx, "usertags", "userid", decoded_uid, tags, false)
+		decoded_uid := store.DecodeUid(uid)
+		args = append(args, decoded_uid)
+
+		query := "UPDATE users SET " + strings.Join(cols, ",") + " WHERE id=?"
+		if expectedUpdatedAt != nil {
+			query += " AND updatedat=?"
+			args = append(args, *expectedUpdatedAt)
+		}
+		res, err := tx.Exec(query, args...)
 		if err != nil {
 			return err
 		}
-	}
 
-	return tx.Commit()
-}
-
-// UserUpdateTags adds or resets user's tags
-func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return nil, err
-	}
+		if expectedUpdatedAt != nil {
+			if count, _ := res.RowsAffected(); count == 0 {
+				// Either the user does not exist, the record was modified, or the update changed nothing.
+				var updatedAt time.Time
+				err = tx.Get(&updatedAt, "SELECT updatedat FROM users WHERE id=? FOR UPDATE", decoded_uid)
+				if err == sql.ErrNoRows {
+					return t.ErrNotFound
+				}
+				if err != nil {
+					return err
+				}
+				if !updatedAt.Equal(*expectedUpdatedAt) {
+					return t.ErrConflict
+				}
+			}
+		}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+		// Tags are also stored in a separate table
+		if tags := extractTags(update); tags != nil {
+			// First delete all user tags
+			_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
+			if err != nil {
+				return err
+			}
+			// Now insert new tags
+			return addTags(tx, "usertags", "userid", decoded_uid, tags, false)
 		}
-	}()
 
-	decoded_uid := store.DecodeUid(uid)
+		return nil
+	})
+}
 
-	if reset != nil {
-		// Delete all tags first if resetting.
-		_, err = tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid)
-		if err != nil {
-			return nil, err
-		}
-		add = reset
-		remove = nil
+// UserUpdateState changes the state of the user, e.g. suspends or reactivates the user.
+func (a *adapter) UserUpdateState(uid t.Uid, state int) error {
+	switch state {
+	case t.StateOK, t.StateSuspended, t.StateDeleted:
+	default:
+		return t.ErrMalformed
 	}
 
-	// Now insert new tags. Ignore duplicates if resetting.
-	err = addTags(tx, "usertags", "userid", decoded_uid, add, reset == nil)
+	res, err := a.db.Exec("UPDATE users SET updatedat=?,state=? WHERE id=? AND deletedat IS NULL",
+		t.TimeNow(), state, store.DecodeUid(uid))
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	// Delete tags.
-	err = removeTags(tx, "usertags", "userid", decoded_uid, remove)
-	if err != nil {
-		return nil, err
+	if count, _ := res.RowsAffected(); count == 0 {
+		return t.ErrNotFound
 	}
+	return nil
+}
+
+// UserUpdateTags adds or resets user's tags
+func (a *adapter) UserUpdateTags(uid t.Uid, add, remove, reset []string) ([]string, error) {
+	decoded_uid := store.DecodeUid(uid)
 
 	var allTags []string
-	err = tx.Select(&allTags, "SELECT tag FROM usertags WHERE userid=?", decoded_uid)
-	if err != nil {
-		return nil, err
-	}
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		if reset != nil {
+			// Delete all tags first if resetting.
+			if _, err := tx.Exec("DELETE FROM usertags WHERE userid=?", decoded_uid); err != nil {
+				return err
+			}
+			add = reset
+			remove = nil
+		}
+
+		// Now insert new tags. Ignore duplicates if resetting.
+		if err := addTags(tx, "usertags", "userid", decoded_uid, add, reset == nil); err != nil {
+			return err
+		}
+
+		// Delete tags.
+		if err := removeTags(tx, "usertags", "userid", decoded_uid, remove); err != nil {
+			return err
+		}
 
-	_, err = tx.Exec("UPDATE users SET tags=? WHERE id=?", t.StringSlice(allTags), decoded_uid)
+		if err := tx.Select(&allTags, "SELECT tag FROM usertags WHERE userid=?", decoded_uid); err != nil {
+			return err
+		}
+
+		_, err := tx.Exec("UPDATE users SET tags=? WHERE id=?", t.StringSlice(allTags), decoded_uid)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return allTags, tx.Commit()
+	return allTags, nil
 }
 
 // UserGetByCred returns user ID for the given validated credential.
@@ -975,7 +2039,8 @@ func (a *adapter) UserGetByCred(method, value string) (t.Uid, error) {
 // the R permission.
 func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
 	var count int
-	err := a.db.Get(&count, "SELECT SUM(t.seqid)-SUM(s.readseqid) FROM topics AS t, subscriptions AS s "+
+	// SUM() returns NULL when nothing matches, hence COALESCE.
+	err := a.db.Get(&count, "SELECT COALESCE(SUM(t.seqid)-SUM(s.readseqid),0) FROM topics AS t, subscriptions AS s "+
 		"WHERE s.userid=? AND t.name=s.topic AND s.deletedat IS NULL AND t.deletedat IS NULL AND "+
 		"INSTR(s.modewant, 'R')>0 AND INSTR(s.modegiven, 'R')>0", store.DecodeUid(uid))
 	if err == nil {
@@ -992,10 +2057,15 @@ func (a *adapter) UserUnreadCount(uid t.Uid) (int, error) {
 // *****************************
 
 func (a *adapter) topicCreate(tx *sqlx.Tx, topic *t.Topic) error {
-	_, err := tx.Exec("INSERT INTO topics(createdAt,updatedAt,touchedAt,name,owner,access,public,tags) "+
-		"VALUES(?,?,?,?,?,?,?,?)",
-		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.Id, store.DecodeUid(t.ParseUid(topic.Owner)),
-		topic.Access, toJSON(topic.Public), topic.Tags)
+	jpub, err := toJSON(topic.Public)
+	if err != nil {
+		return err
+	}
+	// Access and Tags are stored as JSON by their driver.Valuer implementations, same as in UserCreate.
+	_, err = tx.Exec("INSERT INTO topics(createdAt,updatedAt,touchedAt,name,usebt,owner,access,public,tags,pubtext) "+
+		"VALUES(?,?,?,?,?,?,?,?,?,?)",
+		topic.CreatedAt, topic.UpdatedAt, topic.TouchedAt, topic.Id, topic.UseBt, store.DecodeUid(t.ParseUid(topic.Owner)),
+		topic.Access, jpub, topic.Tags, publicText(topic.Public))
 	if err != nil {
 		return err
 	}
@@ -1006,21 +2076,9 @@ func (a *adapter) topicCreate(tx *sqlx.Tx, topic *t.Topic) error {
 
 // TopicCreate saves topic object to database.
 func (a *adapter) TopicCreate(topic *t.Topic) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	err = a.topicCreate(tx, topic)
-	if err != nil {
-		return err
-	}
-	return tx.Commit()
+	return a.withTx(func(tx *sqlx.Tx) error {
+		return a.topicCreate(tx, topic)
+	})
 }
 
 // If undelete = true - update subscription on duplicate key, otherwise ignore the duplicate.
@@ -1028,9 +2086,12 @@ func createSubscription(tx *sqlx.Tx, sub *t.Subscription, undelete bool) error {
 
 	isOwner := (sub.ModeGiven & sub.ModeWant).IsOwner()
 
-	jpriv := toJSON(sub.Private)
+	jpriv, err := toJSON(sub.Private)
+	if err != nil {
+		return err
+	}
 	decoded_uid := store.DecodeUid(t.ParseUid(sub.User))
-	_, err := tx.Exec(
+	_, err = tx.Exec(
 		"INSERT INTO subscriptions(createdAt,updatedAt,deletedAt,userid,topic,modeWant,modeGiven,private) "+
 			"VALUES(?,?,NULL,?,?,?,?,?)",
 		sub.CreatedAt, sub.UpdatedAt, decoded_uid, sub.Topic, sub.ModeWant.String(), sub.ModeGiven.String(), jpriv)
@@ -1056,43 +2117,38 @@ func createSubscription(tx *sqlx.Tx, sub *t.Subscription, undelete bool) error {
 
 // TopicCreateP2P given two users creates a p2p topic
 func (a *adapter) TopicCreateP2P(initiator, invited *t.Subscription) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-	defer func() {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		var err error
+
+		err = createSubscription(tx, initiator, false)
 		if err != nil {
-			tx.Rollback()
+			return err
 		}
-	}()
-
-	err = createSubscription(tx, initiator, false)
-	if err != nil {
-		return err
-	}
-
-	err = createSubscription(tx, invited, true)
-	if err != nil {
-		return err
-	}
 
-	topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
-	topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
-	topic.TouchedAt = initiator.GetTouchedAt()
-	err = a.topicCreate(tx, topic)
-	if err != nil {
-		return err
-	}
+		err = createSubscription(tx, invited, true)
+		if err != nil {
+			return err
+		}
 
-	return tx.Commit()
+		topic := &t.Topic{ObjHeader: t.ObjHeader{Id: initiator.Topic}}
+		topic.ObjHeader.MergeTimes(&initiator.ObjHeader)
+		topic.TouchedAt = initiator.GetTouchedAt()
+		return a.topicCreate(tx, topic)
+	})
 }
 
 // TopicGet loads a single topic by name, if it exists. If the topic does not exist the call returns (nil, nil)
 func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
+	return a.TopicGetCtx(context.Background(), topic)
+}
+
+// TopicGetCtx is the same as TopicGet but the query can be cancelled or timed out by ctx.
+func (a *adapter) TopicGetCtx(ctx context.Context, topic string) (*t.Topic, error) {
 	// Fetch topic by name
 	var tt = new(t.Topic)
-	err := a.db.Get(tt,
-		"SELECT createdat,updatedat,deletedat,touchedat,name AS id,access,owner,seqid,delid,public,tags FROM topics WHERE name=?",
+	err := a.db.GetContext(ctx, tt,
+		"SELECT createdat,updatedat,deletedat,touchedat,name AS id,usebt,access,owner,seqid,delid,public,lastmsg,tags "+
+			"FROM topics WHERE name=?",
 		topic)
 
 	if err != nil {
@@ -1105,13 +2161,121 @@ func (a *adapter) TopicGet(topic string) (*t.Topic, error) {
 
 	tt.Owner = encodeUidString(tt.Owner).String()
 	tt.Public = fromJSON(tt.Public)
+	tt.LastMsg = fromJSON(tt.LastMsg)
 
 	return tt, nil
 }
 
+// TopicsGetAll loads multiple topics by name in one query. Topics which do not exist are skipped.
+// The order of the result is not defined.
+func (a *adapter) TopicsGetAll(names []string) ([]*t.Topic, error) {
+	seen := make(map[string]bool, len(names))
+	args := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		if !seen[name] {
+			seen[name] = true
+			args = append(args, name)
+		}
+	}
+
+	var topics []*t.Topic
+	for _, batch := range chunkArgs(args, a.inBatchSize) {
+		q, batch, _ := sqlx.In("SELECT createdat,updatedat,deletedat,touchedat,name AS id,usebt,access,owner,"+
+			"seqid,delid,public,lastmsg,tags FROM topics WHERE name IN (?)", batch)
+		rows, err := a.db.Queryx(a.db.Rebind(q), batch...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var tt = new(t.Topic)
+			if err = rows.StructScan(tt); err != nil {
+				break
+			}
+			tt.Owner = encodeUidString(tt.Owner).String()
+			tt.Public = fromJSON(tt.Public)
+			tt.LastMsg = fromJSON(tt.LastMsg)
+			topics = append(topics, tt)
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return topics, nil
+}
+
+// TopicsList loads all topics ordered by CreatedAt, then by name, for administrative iteration.
+// If after is not nil, only topics following it in this order are returned: passing the last
+// topic of the previous page fetches the next page. Soft-deleted topics are included only if
+// keepDeleted is true. At most limit topics are returned, capped by maxResults.
+func (a *adapter) TopicsList(after *t.Topic, keepDeleted bool, limit int) ([]*t.Topic, error) {
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	q, args := topicsListQuery(after, keepDeleted, limit)
+	rows, err := a.db.Queryx(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []*t.Topic
+	for rows.Next() {
+		var tt = new(t.Topic)
+		if err = rows.StructScan(tt); err != nil {
+			break
+		}
+		tt.Owner = encodeUidString(tt.Owner).String()
+		tt.Public = fromJSON(tt.Public)
+		tt.LastMsg = fromJSON(tt.LastMsg)
+		topics = append(topics, tt)
+	}
+	rows.Close()
+
+	return topics, err
+}
+
+// topicsListQuery builds the query for fetching a page of all topics.
+func topicsListQuery(after *t.Topic, keepDeleted bool, limit int) (string, []interface{}) {
+	q := "SELECT createdat,updatedat,deletedat,touchedat,name AS id,usebt,access,owner," +
+		"seqid,delid,public,lastmsg,tags FROM topics"
+	var where []string
+	var args []interface{}
+	if !keepDeleted {
+		where = append(where, "deletedat IS NULL")
+	}
+	if after != nil {
+		where = append(where, "(createdat>? OR (createdat=? AND name>?))")
+		args = append(args, after.CreatedAt, after.CreatedAt, after.Id)
+	}
+	if len(where) > 0 {
+		q += " WHERE " + strings.Join(where, " AND ")
+	}
+	q += " ORDER BY createdat,name LIMIT ?"
+	args = append(args, limit)
+	return q, args
+}
+
 // TopicsForUser loads user's contact list: p2p and grp topics, except for 'me' & 'fnd' subscriptions.
 // Reads and denormalizes Public value.
 func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	return a.TopicsForUserCtx(context.Background(), uid, keepDeleted, opts)
+}
+
+// TopicsForUserCtx is the same as TopicsForUser but the query can be cancelled or timed out by ctx.
+// Reads from the primary database if ctx is created by WithPrimary.
+func (a *adapter) TopicsForUserCtx(ctx context.Context, uid t.Uid, keepDeleted bool,
+	opts *t.QueryOpt) ([]t.Subscription, error) {
+	start := time.Now()
+	subs, err := a.topicsForUser(ctx, uid, keepDeleted, opts)
+	a.traceQuery("TopicsForUser", start, err)
+	return subs, err
+}
+
+func (a *adapter) topicsForUser(ctx context.Context, uid t.Uid, keepDeleted bool,
+	opts *t.QueryOpt) ([]t.Subscription, error) {
 	// Fetch user's subscriptions
 	q := `SELECT createdat,updatedat,deletedat,topic,delid,recvseqid,
 		readseqid,modewant,modegiven,private FROM subscriptions WHERE userid=?`
@@ -1124,7 +2288,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 	limit := a.maxResults
 	if opts != nil {
 		// Ignore IfModifiedSince - we must return all entries
-		// Those unmodified will be stripped of Public & Private.
+		// Those unmodified will be stripped of Public & Private below.
 
 		if opts.Topic != "" {
 			q += " AND topic=?"
@@ -1135,10 +2299,16 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 		}
 	}
 
-	q += " LIMIT ?"
-	args = append(args, limit)
+	// Skip 'me' and 'fnd' subscriptions in the query, so they don't count towards the limit.
+	var cats []t.TopicCat
+	if opts != nil {
+		cats = opts.Categories
+	}
+	where, catArgs := topicCatFilter(cats)
+	q += " AND " + where + " LIMIT ?"
+	args = append(append(args, catArgs...), limit)
 
-	rows, err := a.db.Queryx(q, args...)
+	rows, err := a.reader(ctx).QueryxContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1189,19 +2359,19 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 		subs = make([]t.Subscription, 0, len(join))
 	}
 
-	if len(topq) > 0 {
-		// Fetch grp & p2p topics
-		q, topq, _ := sqlx.In(
-			"SELECT createdat,updatedat,deletedat,touchedat,name AS id,access,seqid,delid,public,tags "+
-				"FROM topics WHERE name IN (?)", topq)
+	// Fetch grp & p2p topics in batches to stay within the limit on the number of placeholders.
+	for _, batch := range chunkArgs(topq, a.inBatchSize) {
+		q, batch, _ := sqlx.In(
+			"SELECT createdat,updatedat,deletedat,touchedat,name AS id,access,seqid,delid,public,lastmsg,tags "+
+				"FROM topics WHERE name IN (?)", batch)
 		q = a.db.Rebind(q)
-		rows, err = a.db.Queryx(q, topq...)
+		rows, err = a.reader(ctx).QueryxContext(ctx, q, batch...)
 		if err != nil {
 			return nil, err
 		}
 
-		var top t.Topic
 		for rows.Next() {
+			var top t.Topic
 			if err = rows.StructScan(&top); err != nil {
 				break
 			}
@@ -1210,6 +2380,7 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 			sub.ObjHeader.MergeTimes(&top.ObjHeader)
 			sub.SetTouchedAt(top.TouchedAt)
 			sub.SetSeqId(top.SeqId)
+			sub.SetLastMsg(fromJSON(top.LastMsg))
 			if t.GetTopicCat(sub.Topic) == t.TopicCatGrp {
 				// all done with a grp topic
 				sub.SetPublic(fromJSON(top.Public))
@@ -1220,14 +2391,18 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 			}
 		}
 		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	// Fetch p2p users and join to p2p tables
-	if err == nil && len(usrq) > 0 {
-		q, usrq, _ := sqlx.In(
+	for _, batch := range chunkArgs(usrq, a.inBatchSize) {
+		q, batch, _ := sqlx.In(
 			"SELECT id,state,createdat,updatedat,deletedat,access,lastseen,useragent,public,tags FROM users WHERE id IN (?)",
-			usrq)
-		rows, err = a.db.Queryx(q, usrq...)
+			batch)
+		rows, err = a.reader(ctx).QueryxContext(ctx, q, batch...)
 		if err != nil {
 			return nil, err
 		}
@@ -1254,14 +2429,48 @@ func (a *adapter) TopicsForUser(uid t.Uid, keepDeleted bool, opts *t.QueryOpt) (
 			}
 		}
 		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts != nil && opts.IfModifiedSince != nil {
+		stripUnmodified(subs, *opts.IfModifiedSince)
 	}
 	return subs, err
 }
 
+// stripUnmodified clears Public and Private of subscriptions which have not been updated
+// after ims. The subscriptions are kept so the client knows they still exist.
+func stripUnmodified(subs []t.Subscription, ims time.Time) {
+	for i := range subs {
+		if !subs[i].UpdatedAt.After(ims) {
+			subs[i].SetPublic(nil)
+			subs[i].Private = nil
+		}
+	}
+}
+
 // UsersForTopic loads users subscribed to the given topic.
 // The difference between UsersForTopic vs SubsForTopic is that the former loads user.public,
 // the latter does not.
 func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
+	return a.UsersForTopicCtx(context.Background(), topic, keepDeleted, opts)
+}
+
+// UsersForTopicCtx is the same as UsersForTopic but the query can be cancelled or timed out by ctx.
+// Reads from the primary database if ctx is created by WithPrimary.
+func (a *adapter) UsersForTopicCtx(ctx context.Context, topic string, keepDeleted bool,
+	opts *t.QueryOpt) ([]t.Subscription, error) {
+	start := time.Now()
+	subs, err := a.usersForTopic(ctx, topic, keepDeleted, opts)
+	a.traceQuery("UsersForTopic", start, err)
+	return subs, err
+}
+
+func (a *adapter) usersForTopic(ctx context.Context, topic string, keepDeleted bool,
+	opts *t.QueryOpt) ([]t.Subscription, error) {
 	tcat := t.GetTopicCat(topic)
 
 	// Fetch all subscribed users. The number of users is not large
@@ -1300,10 +2509,10 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 			limit = opts.Limit
 		}
 	}
-	q += " LIMIT ?"
+	q += " ORDER BY s.userid LIMIT ?"
 	args = append(args, limit)
 
-	rows, err := a.db.Queryx(q, args...)
+	rows, err := a.reader(ctx).QueryxContext(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1329,43 +2538,77 @@ func (a *adapter) UsersForTopic(topic string, keepDeleted bool, opts *t.QueryOpt
 	rows.Close()
 
 	if err == nil && tcat == t.TopicCatP2P && len(subs) > 0 {
-		// Swap public values of P2P topics as expected.
-		if len(subs) == 1 {
-			// The other user is deleted, nothing we can do.
-			subs[0].SetPublic(nil)
-		} else {
-			pub := subs[0].GetPublic()
-			subs[0].SetPublic(subs[1].GetPublic())
-			subs[1].SetPublic(pub)
-		}
-
-		// Remove deleted and unneeded subscriptions
-		if !keepDeleted || !oneUser.IsZero() {
-			var xsubs []t.Subscription
-			for i := range subs {
-				if (subs[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && subs[i].Uid() != oneUser) {
-					continue
-				}
-				xsubs = append(xsubs, subs[i])
-			}
-			subs = xsubs
-		}
+		subs = p2pSwapPublic(topic, subs, keepDeleted, oneUser)
 	}
 
 	return subs, err
 }
 
-// OwnTopics loads a slice of topic names where the user is the owner.
-func (a *adapter) OwnTopics(uid t.Uid, opts *t.QueryOpt) ([]string, error) {
-	rows, err := a.db.Queryx("SELECT name FROM topics WHERE owner=?", store.DecodeUid(uid))
+// p2pSwapPublic assigns to each subscription of a p2p topic the public value of the other user:
+// the subscriptions are loaded with users' own public values. Only one subscription of each of
+// the two users named in the topic is kept, any other rows are dropped. Deleted subscriptions
+// are dropped unless keepDeleted is true. If oneUser is not zero, only that user's subscription is kept.
+func p2pSwapPublic(topic string, subs []t.Subscription, keepDeleted bool, oneUser t.Uid) []t.Subscription {
+	uid1, uid2, err := t.ParseP2P(topic)
 	if err != nil {
-		return nil, err
+		return nil
 	}
 
-	var names []string
-	var name string
-	for rows.Next() {
-		if err = rows.Scan(&name); err != nil {
+	publics := make(map[t.Uid]interface{}, 2)
+	var parties []t.Subscription
+	for i := range subs {
+		uid := t.ParseUid(subs[i].User)
+		if uid != uid1 && uid != uid2 {
+			continue
+		}
+		if _, seen := publics[uid]; seen {
+			// Duplicate subscription.
+			continue
+		}
+		publics[uid] = subs[i].GetPublic()
+		parties = append(parties, subs[i])
+	}
+
+	var result []t.Subscription
+	for i := range parties {
+		uid, other := uid1, uid2
+		if t.ParseUid(parties[i].User) == uid2 {
+			uid, other = uid2, uid1
+		}
+		// If the other user is deleted, its public is nil.
+		parties[i].SetPublic(publics[other])
+
+		// Remove deleted and unneeded subscriptions
+		if (parties[i].DeletedAt != nil && !keepDeleted) || (!oneUser.IsZero() && uid != oneUser) {
+			continue
+		}
+		result = append(result, parties[i])
+	}
+	return result
+}
+
+// OwnTopics loads a slice of topic names where the user is the owner. Soft-deleted topics are
+// skipped unless opts.KeepDeleted is set.
+func (a *adapter) OwnTopics(uid t.Uid, opts *t.QueryOpt) ([]string, error) {
+	q := "SELECT name FROM topics WHERE owner=?"
+	args := []interface{}{store.DecodeUid(uid)}
+	if opts == nil || !opts.KeepDeleted {
+		q += " AND deletedat IS NULL"
+	}
+	if opts != nil && opts.Limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, opts.Limit)
+	}
+
+	rows, err := a.db.Queryx(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	var name string
+	for rows.Next() {
+		if err = rows.Scan(&name); err != nil {
 			break
 		}
 		names = append(names, name)
@@ -1376,113 +2619,220 @@ func (a *adapter) OwnTopics(uid t.Uid, opts *t.QueryOpt) ([]string, error) {
 }
 
 func (a *adapter) TopicShare(shares []*t.Subscription) (int, error) {
-	tx, err := a.db.Beginx()
+	var count int
+	err := a.withRetry(func() (err error) {
+		count, err = a.topicShare(shares)
+		return
+	})
+	return count, err
+}
+
+func (a *adapter) topicShare(shares []*t.Subscription) (int, error) {
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		for _, sub := range shares {
+			if err := createSubscription(tx, sub, true); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		return 0, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
 
-	for _, sub := range shares {
-		err = createSubscription(tx, sub, true)
-		if err != nil {
-			return 0, err
+	return len(shares), nil
+}
+
+// TopicSharePartial is the same as TopicShare, but a failure to create one subscription does not
+// abort the whole batch: each share is created under a savepoint which is rolled back on failure.
+// Returns the number of subscriptions created and a list of errors, one per share, nil for
+// the shares which succeeded.
+func (a *adapter) TopicSharePartial(shares []*t.Subscription) (int, []error, error) {
+	var count int
+	var errs []error
+	err := a.withRetry(func() (err error) {
+		count, errs, err = a.topicSharePartial(shares)
+		return
+	})
+	return count, errs, err
+}
+
+func (a *adapter) topicSharePartial(shares []*t.Subscription) (int, []error, error) {
+	var count int
+	errs := make([]error, len(shares))
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		count = 0
+		for i, sub := range shares {
+			if _, err := tx.Exec("SAVEPOINT share"); err != nil {
+				return err
+			}
+			if err := createSubscription(tx, sub, true); err != nil {
+				// Deadlocks and lost connections abort the whole transaction; let the caller retry.
+				if isRetryable(err) {
+					return err
+				}
+				if _, err := tx.Exec("ROLLBACK TO SAVEPOINT share"); err != nil {
+					return err
+				}
+				errs[i] = err
+				continue
+			}
+			if _, err := tx.Exec("RELEASE SAVEPOINT share"); err != nil {
+				return err
+			}
+			errs[i] = nil
+			count++
 		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
 	}
 
-	return len(shares), tx.Commit()
+	return count, errs, nil
 }
 
 // TopicDelete deletes specified topic.
 func (a *adapter) TopicDelete(topic string, hard bool) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
+	return a.withTx(func(tx *sqlx.Tx) error {
+		var err error
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	if hard {
-		if _, err = tx.Exec("DELETE FROM subscriptions WHERE topic=?", topic); err != nil {
-			return err
-		}
+		if hard {
+			if _, err = tx.Exec("DELETE FROM subscriptions WHERE topic=?", topic); err != nil {
+				return err
+			}
 
-		if err = messageDeleteList(tx, topic, nil); err != nil {
-			return err
-		}
+			if err = messageDeleteList(tx, topic, nil); err != nil {
+				return err
+			}
 
-		if _, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic); err != nil {
-			return err
-		}
+			if _, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic); err != nil {
+				return err
+			}
 
-		if _, err = tx.Exec("DELETE FROM topics WHERE name=?", topic); err != nil {
-			return err
-		}
-	} else {
-		now := t.TimeNow()
-		if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic=?", now, now, topic); err != nil {
-			return err
-		}
+			if _, err = tx.Exec("DELETE FROM topics WHERE name=?", topic); err != nil {
+				return err
+			}
+		} else {
+			now := t.TimeNow()
+			if _, err = tx.Exec("UPDATE subscriptions SET updatedat=?,deletedat=? WHERE topic=?", now, now, topic); err != nil {
+				return err
+			}
 
-		if _, err = tx.Exec("UPDATE topics SET updatedat=?,deletedat=? WHERE name=?", now, now, topic); err != nil {
-			return err
+			if _, err = tx.Exec("UPDATE topics SET updatedat=?,deletedat=? WHERE name=?", now, now, topic); err != nil {
+				return err
+			}
 		}
-	}
-	return tx.Commit()
+		return nil
+	})
 }
 
+// TopicUpdateOnMessage updates topic's seqid, touchedat and the preview of the last message when
+// a message is saved. None of them is moved backwards by an out-of-order or replayed message.
 func (a *adapter) TopicUpdateOnMessage(topic string, msg *t.Message) error {
-	_, err := a.db.Exec("UPDATE topics SET seqid=?,touchedat=? WHERE name=?", msg.SeqId, msg.CreatedAt, topic)
+	preview, err := toJSON(messagePreview(msg))
+	if err != nil {
+		return err
+	}
+	// The lastmsg is assigned before seqid: MySQL evaluates assignments left to right using the updated values.
+	// GREATEST returns NULL if any argument is NULL, thus COALESCE for topics never touched before.
+	_, err = a.db.Exec("UPDATE topics SET lastmsg=IF(seqid<=?,?,lastmsg),seqid=GREATEST(seqid,?),"+
+		"touchedat=GREATEST(COALESCE(touchedat,?),?) WHERE name=?",
+		msg.SeqId, preview, msg.SeqId, msg.CreatedAt, msg.CreatedAt, topic)
 
 	return err
 }
 
 func (a *adapter) TopicUpdate(topic string, update map[string]interface{}) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
+	return a.withRetry(func() error {
+		return a.topicUpdate(topic, update)
+	})
+}
 
-	defer func() {
+func (a *adapter) topicUpdate(topic string, update map[string]interface{}) error {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		cols, args, err := updateByMap("topics", update)
 		if err != nil {
-			tx.Rollback()
+			return err
+		}
+		if pub, ok := update["Public"]; ok {
+			// Keep full-text index in sync.
+			cols = append(cols, "pubtext=?")
+			args = append(args, publicText(pub))
+		}
+		args = append(args, topic)
+		_, err = tx.Exec("UPDATE topics SET "+strings.Join(cols, ",")+" WHERE name=?", args...)
+		if err != nil {
+			return err
 		}
-	}()
 
-	cols, args := updateByMap(update)
-	args = append(args, topic)
-	_, err = tx.Exec("UPDATE topics SET "+strings.Join(cols, ",")+" WHERE name=?", args...)
-	if err != nil {
-		return err
-	}
+		// Tags are also stored in a separate table
+		if tags := extractTags(update); tags != nil {
+			// First delete all user tags
+			_, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic)
+			if err != nil {
+				return err
+			}
+			// Now insert new tags
+			err = addTags(tx, "topictags", "topic", topic, tags, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// TopicOwnerChange makes newOwner the owner of the topic. The new owner must already have
+// a subscription to the topic with the owner permission both wanted and given: the caller
+// is responsible for updating access modes of both the old and the new owner.
+// Returns t.ErrNotFound if the topic does not exist or the new owner is not subscribed,
+// t.ErrMalformed if the subscription does not grant ownership, t.ErrConflict if oldOwner is not
+// the current owner, i.e. the ownership has changed concurrently. The check of the current owner
+// is skipped if oldOwner is zero. Repeating a completed change is not an error.
+func (a *adapter) TopicOwnerChange(topic string, newOwner, oldOwner t.Uid) error {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		var err error
 
-	// Tags are also stored in a separate table
-	if tags := extractTags(update); tags != nil {
-		// First delete all user tags
-		_, err = tx.Exec("DELETE FROM topictags WHERE topic=?", topic)
+		decoded_uid := store.DecodeUid(newOwner)
+
+		// Lock the topic so the owner cannot change until the transaction ends.
+		var owner int64
+		err = tx.Get(&owner, "SELECT owner FROM topics WHERE name=? AND deletedat IS NULL FOR UPDATE", topic)
+		if err == sql.ErrNoRows {
+			return t.ErrNotFound
+		}
 		if err != nil {
 			return err
 		}
-		// Now insert new tags
-		err = addTags(tx, "topictags", "topic", topic, tags, false)
+		if owner == decoded_uid {
+			// Already the owner.
+			return nil
+		}
+		if !oldOwner.IsZero() && owner != store.DecodeUid(oldOwner) {
+			return t.ErrConflict
+		}
+
+		var sub struct {
+			Modewant  t.AccessMode
+			Modegiven t.AccessMode
+		}
+		err = tx.Get(&sub, "SELECT modewant,modegiven FROM subscriptions WHERE topic=? AND userid=? AND deletedat IS NULL "+
+			"FOR UPDATE", topic, decoded_uid)
+		if err == sql.ErrNoRows {
+			return t.ErrNotFound
+		}
 		if err != nil {
 			return err
 		}
-	}
-
-	return tx.Commit()
-}
+		if !(sub.Modewant & sub.Modegiven).IsOwner() {
+			return t.ErrMalformed
+		}
 
-func (a *adapter) TopicOwnerChange(topic string, newOwner, oldOwner t.Uid) error {
-	_, err := a.db.Exec("UPDATE topics SET owner=? WHERE name=?", store.DecodeUid(newOwner), topic)
-	return err
+		_, err = tx.Exec("UPDATE topics SET owner=? WHERE name=?", decoded_uid, topic)
+		return err
+	})
 }
 
 // Get a subscription of a user to a topic
@@ -1509,15 +2859,69 @@ func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, er
 	return &sub, nil
 }
 
-// Update time when the user was last attached to the topic
-func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]time.Time) error {
-	_, err := a.db.Exec("UPDATE subscriptions SET lastseen=?,useragent=? WHERE topic=? AND userid=?",
-		lastSeen["LastSeen"], lastSeen["UserAgent"], topic, store.DecodeUid(user))
+// SubscriptionGetWithPublic is the same as SubscriptionGet but it also loads Public: the public
+// value of the topic for group topics or of the other user for p2p topics. If the other p2p user
+// is deleted, Public is nil.
+func (a *adapter) SubscriptionGetWithPublic(topic string, user t.Uid) (*t.Subscription, error) {
+	sub, err := a.SubscriptionGet(topic, user)
+	if err != nil || sub == nil {
+		return sub, err
+	}
+
+	var public interface{}
+	switch t.GetTopicCat(topic) {
+	case t.TopicCatP2P:
+		err = a.db.Get(&public, "SELECT u.public FROM subscriptions AS s JOIN users AS u ON s.userid=u.id "+
+			"WHERE s.topic=? AND s.userid<>? AND u.deletedat IS NULL", topic, store.DecodeUid(user))
+	case t.TopicCatGrp:
+		err = a.db.Get(&public, "SELECT public FROM topics WHERE name=?", topic)
+	default:
+		return sub, nil
+	}
+
+	if err != nil {
+		if err != sql.ErrNoRows {
+			return nil, err
+		}
+		// The other user or the topic is gone.
+		public = nil
+	}
+	sub.SetPublic(fromJSON(public))
+
+	return sub, nil
+}
+
+// SubsLastSeen updates the time when the user was last attached to the topic and the User-Agent
+// of the session, lastSeen["LastSeen"] and lastSeen["UserAgent"], whichever is present.
+// Last seen time is not tracked per subscription: it's stored in the users table, where
+// TopicsForUser reads it from. The update is applied only if the user is subscribed to the topic.
+func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]interface{}) error {
+	update := make(map[string]interface{})
+	for _, key := range []string{"LastSeen", "UserAgent"} {
+		if val, ok := lastSeen[key]; ok {
+			update[key] = val
+		}
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	cols, args, err := updateByMap("users", update)
+	if err != nil {
+		return err
+	}
+
+	_, err = a.db.Exec("UPDATE users SET "+strings.Join(cols, ",")+" WHERE id=? AND EXISTS "+
+		"(SELECT 1 FROM subscriptions WHERE topic=? AND userid=users.id AND deletedat IS NULL)",
+		append(args, store.DecodeUid(user), topic)...)
 
 	return err
 }
 
 // SubsForUser loads a list of user's subscriptions to topics. Does NOT load Public value.
+// Subscriptions are ordered by UpdatedAt then by topic name. If opts.IfModifiedSince is set, only
+// subscriptions updated after it are returned; with opts.AfterTopic, subscriptions updated at exactly
+// opts.IfModifiedSince with topic names greater than opts.AfterTopic are returned too. Passing the
+// values of the last subscription of the previous page fetches the next page.
 // TODO: this is used only for presence notifications, no need to load Private either.
 func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt) ([]t.Subscription, error) {
 	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
@@ -1530,18 +2934,24 @@ func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt)
 
 	limit := a.maxResults // maxResults here, not maxSubscribers
 	if opts != nil {
-		// Ignore IfModifiedSince - we must return all entries
-		// Those unmodified will be stripped of Public & Private.
-
 		if opts.Topic != "" {
 			q += " AND topic=?"
 			args = append(args, opts.Topic)
 		}
+		if opts.IfModifiedSince != nil {
+			if opts.AfterTopic != "" {
+				q += " AND (updatedat>? OR (updatedat=? AND topic>?))"
+				args = append(args, opts.IfModifiedSince, opts.IfModifiedSince, opts.AfterTopic)
+			} else {
+				q += " AND updatedat>?"
+				args = append(args, opts.IfModifiedSince)
+			}
+		}
 		if opts.Limit > 0 && opts.Limit < limit {
 			limit = opts.Limit
 		}
 	}
-	q += " LIMIT ?"
+	q += " ORDER BY updatedat,topic LIMIT ?"
 	args = append(args, limit)
 
 	rows, err := a.db.Queryx(q, args...)
@@ -1564,6 +2974,45 @@ func (a *adapter) SubsForUser(forUser t.Uid, keepDeleted bool, opts *t.QueryOpt)
 	return subs, err
 }
 
+// SubsModifiedSince loads subscriptions of all users and topics updated at or after the given time,
+// including soft-deleted ones. Subscriptions are ordered by UpdatedAt, then by topic and user.
+// If after is not nil, only subscriptions following it in this order are returned: passing the last
+// subscription of the previous page fetches the next page. Does NOT load Public value.
+func (a *adapter) SubsModifiedSince(since time.Time, after *t.Subscription, limit int) ([]t.Subscription, error) {
+	q := `SELECT createdat,updatedat,deletedat,userid AS user,topic,delid,recvseqid,
+		readseqid,modewant,modegiven,private FROM subscriptions WHERE updatedat>=?`
+	args := []interface{}{since}
+	if after != nil {
+		q += " AND (updatedat>? OR (updatedat=? AND (topic>? OR (topic=? AND userid>?))))"
+		args = append(args, after.UpdatedAt, after.UpdatedAt, after.Topic, after.Topic,
+			store.DecodeUid(t.ParseUid(after.User)))
+	}
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	q += " ORDER BY updatedat,topic,userid LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := a.db.Queryx(q, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []t.Subscription
+	var ss t.Subscription
+	for rows.Next() {
+		if err = rows.StructScan(&ss); err != nil {
+			break
+		}
+		ss.User = encodeUidString(ss.User).String()
+		ss.Private = fromJSON(ss.Private)
+		subs = append(subs, ss)
+	}
+	rows.Close()
+
+	return subs, err
+}
+
 // SubsForTopic fetches all subsciptions for a topic. Does NOT load Public value.
 // The difference between UsersForTopic vs SubsForTopic is that the former loads user.public,
 // the latter does not.
@@ -1576,7 +3025,6 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 		// Filter out rows where DeletedAt is defined
 		q += " AND deletedAt IS NULL"
 	}
-	limit := a.maxResults
 	if opts != nil {
 		// Ignore IfModifiedSince - we must return all entries
 		// Those unmodified will be stripped of Public & Private.
@@ -1585,13 +3033,16 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 			q += " AND userid=?"
 			args = append(args, store.DecodeUid(opts.User))
 		}
-		if opts.Limit > 0 && opts.Limit < limit {
-			limit = opts.Limit
+		if cond, modes := modeFilter(opts.Mode); cond != "" {
+			q += " AND " + cond
+			args = append(args, modes...)
 		}
 	}
 
-	q += " LIMIT ?"
-	args = append(args, limit)
+	if limit := a.resultLimit(opts); limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
 
 	rows, err := a.db.Queryx(q, args...)
 	if err != nil {
@@ -1616,18 +3067,26 @@ func (a *adapter) SubsForTopic(topic string, keepDeleted bool, opts *t.QueryOpt)
 
 // SubsUpdate updates one or multiple subscriptions to a topic.
 func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interface{}) error {
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
+	_, err := a.SubsUpdateCount(topic, user, update)
+	return err
+}
 
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
+// SubsUpdateCount is the same as SubsUpdate but it also returns the number of subscriptions
+// which were changed. Subscriptions which already had the new values are not counted.
+func (a *adapter) SubsUpdateCount(topic string, user t.Uid, update map[string]interface{}) (int, error) {
+	var count int
+	err := a.withRetry(func() (err error) {
+		count, err = a.subsUpdate(topic, user, update)
+		return
+	})
+	return count, err
+}
 
-	cols, args := updateByMap(update)
+func (a *adapter) subsUpdate(topic string, user t.Uid, update map[string]interface{}) (int, error) {
+	cols, args, err := updateByMap("subscriptions", update)
+	if err != nil {
+		return 0, err
+	}
 	q := "UPDATE subscriptions SET " + strings.Join(cols, ",") + " WHERE topic=?"
 	args = append(args, topic)
 	if !user.IsZero() {
@@ -1636,11 +3095,74 @@ func (a *adapter) SubsUpdate(topic string, user t.Uid, update map[string]interfa
 		args = append(args, store.DecodeUid(user))
 	}
 
-	if _, err = tx.Exec(q, args...); err != nil {
-		return err
+	res, err := a.db.Exec(q, args...)
+	if err != nil {
+		return 0, err
 	}
+	count, err := res.RowsAffected()
+	return int(count), err
+}
 
-	return tx.Commit()
+// SubsUpdateReadRecv advances the read and received markers of the user's subscription to the topic.
+// The markers never move backwards: a value lower than the stored one is ignored, so a stale
+// update cannot make read messages unread. The received marker is advanced to at least read.
+// Values <= 0 are ignored.
+func (a *adapter) SubsUpdateReadRecv(topic string, user t.Uid, read, recv int) error {
+	q, args := readRecvUpdate(read, recv, t.TimeNow())
+	if q == "" {
+		return nil
+	}
+	_, err := a.db.Exec(q+" WHERE topic=? AND userid=?", append(args, topic, store.DecodeUid(user))...)
+	return err
+}
+
+// readRecvUpdate builds the UPDATE statement which advances the read and received markers.
+// Returns an empty query if there is nothing to update.
+func readRecvUpdate(read, recv int, now time.Time) (string, []interface{}) {
+	if recv < read {
+		recv = read
+	}
+	if recv <= 0 {
+		return "", nil
+	}
+
+	// MySQL assigns columns left to right, updatedat must be set while the old values are still there.
+	var cols []string
+	var cond []string
+	var vals []interface{}
+	if read > 0 {
+		cond = append(cond, "readseqid<?")
+		cols = append(cols, "readseqid=GREATEST(readseqid,?)")
+		vals = append(vals, read)
+	}
+	cond = append(cond, "recvseqid<?")
+	cols = append(cols, "recvseqid=GREATEST(recvseqid,?)")
+	vals = append(vals, recv)
+
+	// The values are used twice: in the condition and in the assignments.
+	args := append([]interface{}{}, vals...)
+	args = append(args, now)
+	args = append(args, vals...)
+	return "UPDATE subscriptions SET updatedat=IF(" + strings.Join(cond, " OR ") + ",?,updatedat)," +
+		strings.Join(cols, ","), args
+}
+
+// SubsCountForTopic returns the total number of subscriptions to the topic, not capped by maxResults.
+// Soft-deleted subscriptions are counted only if keepDeleted is true.
+func (a *adapter) SubsCountForTopic(topic string, keepDeleted bool) (int, error) {
+	return a.SubsCountForTopicCtx(context.Background(), topic, keepDeleted)
+}
+
+// SubsCountForTopicCtx is the same as SubsCountForTopic but the query can be cancelled or timed out
+// by ctx. Reads from the primary database if ctx is created by WithPrimary.
+func (a *adapter) SubsCountForTopicCtx(ctx context.Context, topic string, keepDeleted bool) (int, error) {
+	q := "SELECT COUNT(*) FROM subscriptions WHERE topic=?"
+	if !keepDeleted {
+		q += " AND deletedat IS NULL"
+	}
+	var count int
+	err := a.reader(ctx).GetContext(ctx, &count, q, topic)
+	return count, err
 }
 
 // SubsDelete marks subscription as deleted.
@@ -1660,76 +3182,115 @@ func (a *adapter) SubsDelete(topic string, user t.Uid) error {
 
 // SubsDelForTopic marks all subscriptions to the given topic as deleted
 func (a *adapter) SubsDelForTopic(topic string, hard bool) error {
-	var err error
-	if hard {
-		_, err = a.db.Exec("DELETE FROM subscriptions WHERE topic=?", topic)
-	} else {
-		now := t.TimeNow()
-		_, err = a.db.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? WHERE topic=? AND deletedat IS NULL",
-			now, now, topic)
-	}
+	_, err := a.SubsDelForTopicCount(topic, hard)
 	return err
 }
 
-// subsDelForTopic marks user's subscriptions as deleted
-func subsDelForUser(tx *sqlx.Tx, user t.Uid, hard bool) error {
+// SubsDelForTopicCount is the same as SubsDelForTopic but it also returns the number of
+// deleted subscriptions.
+func (a *adapter) SubsDelForTopicCount(topic string, hard bool) (int, error) {
+	var res sql.Result
 	var err error
 	if hard {
-		_, err = tx.Exec("DELETE FROM subscriptions WHERE userid=?", store.DecodeUid(user))
+		res, err = a.db.Exec("DELETE FROM subscriptions WHERE topic=?", topic)
 	} else {
 		now := t.TimeNow()
-		_, err = tx.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? WHERE userid=?",
-			now, now, store.DecodeUid(user))
+		res, err = a.db.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? WHERE topic=? AND deletedat IS NULL",
+			now, now, topic)
 	}
-	return err
-}
-
-// SubsDelForTopic marks user's subscriptions as deleted
-func (a *adapter) SubsDelForUser(user t.Uid, hard bool) error {
-	tx, err := a.db.Beginx()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	count, err := res.RowsAffected()
+	return int(count), err
+}
 
-	defer func() {
+// SubsDelForTopicBatched is the same as SubsDelForTopicCount but subscriptions are deleted in batches
+// of batchSize rows ordered by id. Each batch is a separate statement, which keeps row locks short
+// for topics with a large number of subscribers. Returns the total number of deleted subscriptions.
+func (a *adapter) SubsDelForTopicBatched(topic string, hard bool, batchSize int) (int, error) {
+	if batchSize <= 0 {
+		return a.SubsDelForTopicCount(topic, hard)
+	}
+
+	var total int
+	for {
+		var res sql.Result
+		var err error
+		if hard {
+			res, err = a.db.Exec("DELETE FROM subscriptions WHERE topic=? ORDER BY id LIMIT ?", topic, batchSize)
+		} else {
+			now := t.TimeNow()
+			res, err = a.db.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? WHERE topic=? AND deletedat IS NULL "+
+				"ORDER BY id LIMIT ?", now, now, topic, batchSize)
+		}
 		if err != nil {
-			tx.Rollback()
+			return total, err
+		}
+		count, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += int(count)
+		if int(count) < batchSize {
+			return total, nil
 		}
-	}()
-
-	if err = subsDelForUser(tx, user, hard); err != nil {
-		return err
 	}
+}
 
-	return tx.Commit()
+// subsDelForTopic marks user's subscriptions as deleted
+func subsDelForUser(tx *sqlx.Tx, user t.Uid, hard bool) error {
+	var err error
+	if hard {
+		_, err = tx.Exec("DELETE FROM subscriptions WHERE userid=?", store.DecodeUid(user))
+	} else {
+		now := t.TimeNow()
+		_, err = tx.Exec("UPDATE subscriptions SET updatedat=?, deletedat=? WHERE userid=?",
+			now, now, store.DecodeUid(user))
+	}
+	return err
+}
 
+// SubsDelForTopic marks user's subscriptions as deleted
+func (a *adapter) SubsDelForUser(user t.Uid, hard bool) error {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		return subsDelForUser(tx, user, hard)
+	})
 }
 
 // Returns a list of users who match given tags, such as "email:jdoe@example.com" or "tel:+18003287448".
 // Searching the 'users.Tags' for the given tags using respective index.
 func (a *adapter) FindUsers(uid t.Uid, req, opt []string) ([]t.Subscription, error) {
+	return a.FindUsersCtx(context.Background(), uid, req, opt)
+}
+
+// FindUsersCtx is the same as FindUsers but the query can be cancelled or timed out by ctx.
+// Reads from the primary database if ctx is created by WithPrimary.
+func (a *adapter) FindUsersCtx(ctx context.Context, uid t.Uid, req, opt []string) ([]t.Subscription, error) {
+	start := time.Now()
+	subs, err := a.findUsers(ctx, uid, req, opt)
+	a.traceQuery("FindUsers", start, err)
+	return subs, err
+}
+
+func (a *adapter) findUsers(ctx context.Context, uid t.Uid, req, opt []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
-	var args []interface{}
-	for _, tag := range append(req, opt...) {
-		args = append(args, tag)
-		index[tag] = struct{}{}
+	for _, tags := range [][]string{req, opt} {
+		for _, tag := range tags {
+			index[tag] = struct{}{}
+		}
 	}
 
-	query := "SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.tags,COUNT(*) AS matches " +
-		"FROM users AS u LEFT JOIN usertags AS t ON t.userid=u.id " +
-		"WHERE t.tag IN (?" + strings.Repeat(",?", len(req)+len(opt)-1) + ") AND u.deletedat IS NULL " +
-		"GROUP BY u.id,u.createdat,u.updatedat,u.public,u.tags "
-	if len(req) > 0 {
-		query += "HAVING COUNT(t.tag IN (?" + strings.Repeat(",?", len(req)-1) + ") OR NULL)>=? "
-		for _, tag := range req {
-			args = append(args, tag)
-		}
-		args = append(args, len(req))
+	query, args, err := tagSearchQuery("SELECT u.id,u.createdat,u.updatedat,u.access,u.public,u.tags,COUNT(*) AS matches "+
+		"FROM users AS u LEFT JOIN usertags AS t ON t.userid=u.id", "t.tag",
+		"u.deletedat IS NULL", "u.id,u.createdat,u.updatedat,u.public,u.tags", "matches DESC",
+		req, opt, a.maxResults)
+	if err != nil {
+		return nil, err
 	}
-	query += "ORDER BY matches DESC LIMIT ?"
 
 	// Get users matched by tags, sort by number of matches from high to low.
-	rows, err := a.db.Queryx(query, append(args, a.maxResults)...)
+	rows, err := a.reader(ctx).QueryxContext(ctx, query, args...)
 
 	if err != nil {
 		return nil, err
@@ -1773,27 +3334,25 @@ func (a *adapter) FindUsers(uid t.Uid, req, opt []string) ([]t.Subscription, err
 
 // Returns a list of topics with matching tags.
 // Searching the 'topics.Tags' for the given tags using respective index.
+// Topics are ordered by the number of matching tags, then by the most recently updated,
+// then by name.
 func (a *adapter) FindTopics(req, opt []string) ([]t.Subscription, error) {
 	index := make(map[string]struct{})
-	var args []interface{}
-	for _, tag := range append(req, opt...) {
-		args = append(args, tag)
-		index[tag] = struct{}{}
+	for _, tags := range [][]string{req, opt} {
+		for _, tag := range tags {
+			index[tag] = struct{}{}
+		}
 	}
 
-	query := "SELECT t.name AS topic,t.createdat,t.updatedat,t.access,t.public,t.tags,COUNT(*) AS matches " +
-		"FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic " +
-		"WHERE tt.tag IN (?" + strings.Repeat(",?", len(req)+len(opt)-1) + ") AND t.deletedat IS NULL " +
-		"GROUP BY t.name,t.createdat,t.updatedat,t.public,t.tags "
-	if len(req) > 0 {
-		query += "HAVING COUNT(tt.tag IN (?" + strings.Repeat(",?", len(req)-1) + ") OR NULL)>=? "
-		for _, tag := range append(req) {
-			args = append(args, tag)
-		}
-		args = append(args, len(req))
+	query, args, err := tagSearchQuery("SELECT t.name AS topic,t.createdat,t.updatedat,t.access,t.public,t.tags,COUNT(*) AS matches "+
+		"FROM topics AS t LEFT JOIN topictags AS tt ON t.name=tt.topic", "tt.tag",
+		"t.deletedat IS NULL", "t.name,t.createdat,t.updatedat,t.public,t.tags", "matches DESC,t.updatedat DESC,t.name",
+		req, opt, a.maxResults)
+	if err != nil {
+		return nil, err
 	}
-	query += "ORDER BY matches DESC LIMIT ?"
-	rows, err := a.db.Queryx(query, append(args, a.maxResults)...)
+
+	rows, err := a.db.Queryx(query, args...)
 
 	if err != nil {
 		return nil, err
@@ -1827,75 +3386,633 @@ func (a *adapter) FindTopics(req, opt []string) ([]t.Subscription, error) {
 	if err != nil {
 		return nil, err
 	}
-	return subs, nil
+	return subs, nil
+
+}
+
+// tagSearchQuery builds a query which finds objects having any of the required or optional tags and all
+// of the required tags. The tag lists are expanded by sqlx.In.
+func tagSearchQuery(selectFrom, tagCol, where, groupBy, orderBy string, req, opt []string,
+	limit int) (string, []interface{}, error) {
+
+	all := make([]string, 0, len(req)+len(opt))
+	all = append(append(all, req...), opt...)
+
+	query := selectFrom + " WHERE " + tagCol + " IN (?) AND " + where + " GROUP BY " + groupBy
+	args := []interface{}{all}
+	if len(req) > 0 {
+		// The IN() expression is 1 for a required tag and 0 otherwise: the sum is the number of
+		// required tags the object has.
+		query += " HAVING SUM(" + tagCol + " IN (?))>=?"
+		args = append(args, req, len(req))
+	}
+	query += " ORDER BY " + orderBy + " LIMIT ?"
+	args = append(args, limit)
+
+	return sqlx.In(query, args...)
+}
+
+// FindTopicsByText returns a list of group topics with public data matching the query. Each word of
+// the query is matched as a prefix. Topics are ordered by relevance.
+func (a *adapter) FindTopicsByText(query string) ([]t.Subscription, error) {
+	terms := fullTextTerms(query)
+	if terms == "" {
+		return nil, nil
+	}
+
+	rows, err := a.db.Queryx("SELECT name AS topic,createdat,updatedat,access,public,"+
+		"MATCH(pubtext) AGAINST(? IN BOOLEAN MODE) AS score FROM topics "+
+		"WHERE MATCH(pubtext) AGAINST(? IN BOOLEAN MODE) AND deletedat IS NULL AND name LIKE 'grp%' "+
+		"ORDER BY score DESC LIMIT ?", terms, terms, a.maxResults)
+	if err != nil {
+		return nil, err
+	}
+
+	var access t.DefaultAccess
+	var public interface{}
+	var ignored float64
+	var sub t.Subscription
+	var subs []t.Subscription
+	for rows.Next() {
+		if err = rows.Scan(&sub.Topic, &sub.CreatedAt, &sub.UpdatedAt, &access, &public, &ignored); err != nil {
+			subs = nil
+			break
+		}
+
+		sub.SetPublic(fromJSON(public))
+		sub.SetDefaultAccess(access.Auth, access.Anon)
+		subs = append(subs, sub)
+	}
+	rows.Close()
+
+	return subs, err
+}
+
+// Messages
+// If the outbox is enabled, the message is also recorded in the outbox in the same transaction.
+func (a *adapter) MessageSave(msg *t.Message) error {
+	if !a.outbox {
+		return messageSave(a.db, msg)
+	}
+
+	return a.withTx(func(tx *sqlx.Tx) error {
+		if err := messageSave(tx, msg); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO msgoutbox(createdat,msgid) VALUES(?,?)", t.TimeNow(), int64(msg.Uid()))
+		return err
+	})
+}
+
+func messageSave(db sqlx.Execer, msg *t.Message) error {
+	content, err := toJSON(msg.Content)
+	if err != nil {
+		return err
+	}
+	res, err := db.Exec(
+		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content) VALUES(?,?,?,?,?,?,?)",
+		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, content)
+	if err == nil {
+		id, _ := res.LastInsertId()
+		msg.SetUid(t.Uid(id))
+	}
+	return err
+}
+
+// MessageSaveAll saves a batch of messages using multi-row INSERTs and assigns IDs to them.
+// If any message duplicates an existing topic:seqid, nothing is saved and t.ErrDuplicate is returned.
+func (a *adapter) MessageSaveAll(msgs []*t.Message) error {
+	return a.withRetry(func() error {
+		return a.messageSaveAll(msgs)
+	})
+}
+
+func (a *adapter) messageSaveAll(msgs []*t.Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return a.withTx(func(tx *sqlx.Tx) error {
+		var err error
+
+		// Each message takes 7 placeholders.
+		batchSize := a.inBatchSize
+		if batchSize <= 0 || batchSize > maxInBatchSize/7 {
+			batchSize = maxInBatchSize / 7
+		}
+
+		for len(msgs) > 0 {
+			batch := msgs
+			if len(batch) > batchSize {
+				batch = batch[:batchSize]
+			}
+			msgs = msgs[len(batch):]
+
+			var args []interface{}
+			var keys []interface{}
+			byKey := make(map[string]*t.Message, len(batch))
+			for _, msg := range batch {
+				content, err := toJSON(msg.Content)
+				if err != nil {
+					return err
+				}
+				args = append(args, msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
+					store.DecodeUid(t.ParseUid(msg.From)), msg.Head, content)
+				keys = append(keys, msg.Topic, msg.SeqId)
+				byKey[msg.Topic+":"+strconv.Itoa(msg.SeqId)] = msg
+			}
+
+			_, err = tx.Exec("INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content) VALUES (?,?,?,?,?,?,?)"+
+				strings.Repeat(",(?,?,?,?,?,?,?)", len(batch)-1), args...)
+			if err != nil {
+				if isDupe(err) {
+					err = t.ErrDuplicate
+				}
+				return err
+			}
+
+			// Auto-increment IDs of a multi-row insert are not guaranteed to be consecutive, read them back.
+			var rows *sqlx.Rows
+			rows, err = tx.Queryx("SELECT id,topic,seqid FROM messages WHERE (topic,seqid) IN ((?,?)"+
+				strings.Repeat(",(?,?)", len(batch)-1)+")", keys...)
+			if err != nil {
+				return err
+			}
+			var id int64
+			var topic string
+			var seqId int
+			for rows.Next() {
+				if err = rows.Scan(&id, &topic, &seqId); err != nil {
+					break
+				}
+				if msg := byKey[topic+":"+strconv.Itoa(seqId)]; msg != nil {
+					msg.SetUid(t.Uid(id))
+				}
+			}
+			rows.Close()
+			if err != nil {
+				return err
+			}
+
+			if a.outbox {
+				_, err = tx.Exec("INSERT INTO msgoutbox(createdat,msgid) SELECT ?,id FROM messages WHERE (topic,seqid) IN ((?,?)"+
+					strings.Repeat(",(?,?)", len(batch)-1)+") ORDER BY seqid", append([]interface{}{t.TimeNow()}, keys...)...)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// OutboxFetch returns up to limit messages from the outbox in the order they were saved.
+// Messages remain in the outbox until acknowledged by OutboxAck, i.e. a message may be
+// returned more than once if the relay fails before acknowledging it.
+func (a *adapter) OutboxFetch(limit int) ([]t.Message, error) {
+	if limit <= 0 || limit > a.maxResults {
+		limit = a.maxResults
+	}
+	rows, err := a.db.Queryx("SELECT m.id,m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content "+
+		"FROM msgoutbox AS o INNER JOIN messages AS m ON m.id=o.msgid ORDER BY o.id LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		id, _ := strconv.ParseInt(msg.Id, 10, 64)
+		msg.SetUid(t.Uid(id))
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	return msgs, err
+}
+
+// OutboxAck removes delivered messages from the outbox.
+func (a *adapter) OutboxAck(msgIds ...t.Uid) error {
+	ids := make([]interface{}, 0, len(msgIds))
+	for _, id := range msgIds {
+		ids = append(ids, int64(id))
+	}
+
+	for _, batch := range chunkArgs(ids, a.inBatchSize) {
+		q, batch, _ := sqlx.In("DELETE FROM msgoutbox WHERE msgid IN (?)", batch)
+		if _, err := a.db.Exec(a.db.Rebind(q), batch...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
+	return a.MessageGetAllCtx(context.Background(), topic, forUser, opts)
+}
+
+// MessageGetAllCtx is the same as MessageGetAll but the query can be cancelled or timed out by ctx.
+// If a read replica is configured, it's used unless ctx is created by WithPrimary.
+func (a *adapter) MessageGetAllCtx(ctx context.Context, topic string, forUser t.Uid,
+	opts *t.QueryOpt) ([]t.Message, error) {
+	start := time.Now()
+	msgs, err := a.messageGetAll(ctx, topic, forUser, opts)
+	a.traceQuery("MessageGetAll", start, err)
+	return msgs, err
+}
+
+func (a *adapter) messageGetAll(ctx context.Context, topic string, forUser t.Uid,
+	opts *t.QueryOpt) ([]t.Message, error) {
+	q, args := a.messageQuery(topic, forUser, opts)
+	rows, err := a.reader(ctx).QueryxContext(ctx, q, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var msgs []t.Message
+	for rows.Next() {
+		var msg t.Message
+		if err = rows.StructScan(&msg); err != nil {
+			break
+		}
+		msg.From = encodeUidString(msg.From).String()
+		msg.Content = fromJSON(msg.Content)
+		msgs = append(msgs, msg)
+	}
+	rows.Close()
+	return msgs, err
+}
+
+// messageQuery builds the query for fetching messages of the topic visible to the given user.
+func (a *adapter) messageQuery(topic string, forUser t.Uid, opts *t.QueryOpt) (string, []interface{}) {
+	var lower = 0
+	var upper = 1 << 31
+
+	if opts != nil {
+		if opts.Since > 0 {
+			lower = opts.Since
+		}
+		if opts.Before > 0 {
+			// MySQL BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
+			upper = opts.Before - 1
+		}
+	}
+
+	unum := store.DecodeUid(forUser)
+	// Skip messages soft-deleted for the user. Ranges in dellog are inclusive-exclusive [low, hi).
+	// The subquery is resolved using the dellog_topic_deletedfor_low_hi index.
+	q := "SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content" +
+		" FROM messages AS m" +
+		" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ? AND NOT EXISTS" +
+		" (SELECT 1 FROM dellog AS d WHERE d.topic=m.topic AND d.deletedfor=? AND d.low<=m.seqid AND d.hi>m.seqid)" +
+		" ORDER BY m.seqid " + seqIdOrder(opts)
+	args := []interface{}{topic, lower, upper, unum}
+	if limit := a.resultLimit(opts); limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+	return q, args
+}
+
+// MessageGetByIds loads messages of the topic with the given SeqIDs, ordered by SeqID. Messages
+// which are deleted or soft-deleted for the user are skipped, as are SeqIDs which do not exist.
+func (a *adapter) MessageGetByIds(topic string, forUser t.Uid, seqIds []int) ([]t.Message, error) {
+	var msgs []t.Message
+	for _, batch := range chunkArgs(uniqueSeqIds(seqIds), a.inBatchSize) {
+		q, args := messageIdsQuery(topic, forUser, batch)
+		rows, err := a.db.Queryx(q, args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var msg t.Message
+			if err = rows.StructScan(&msg); err != nil {
+				break
+			}
+			msg.From = encodeUidString(msg.From).String()
+			msg.Content = fromJSON(msg.Content)
+			msgs = append(msgs, msg)
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
+
+// uniqueSeqIds sorts SeqIDs and removes duplicates, so that batches return messages in order.
+func uniqueSeqIds(seqIds []int) []interface{} {
+	sorted := append([]int(nil), seqIds...)
+	sort.Ints(sorted)
+
+	var ids []interface{}
+	for i, id := range sorted {
+		if i == 0 || id != sorted[i-1] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// messageIdsQuery builds the query for fetching messages with the given SeqIDs visible to the user.
+func messageIdsQuery(topic string, forUser t.Uid, seqIds []interface{}) (string, []interface{}) {
+	q, args, _ := sqlx.In("SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content"+
+		" FROM messages AS m"+
+		" WHERE m.delid=0 AND m.topic=? AND m.seqid IN (?) AND NOT EXISTS"+
+		" (SELECT 1 FROM dellog AS d WHERE d.topic=m.topic AND d.deletedfor=? AND d.low<=m.seqid AND d.hi>m.seqid)"+
+		" ORDER BY m.seqid", topic, seqIds, store.DecodeUid(forUser))
+	return q, args
+}
+
+// MessageIterator iterates over messages returned by MessageStream. Must be closed after use.
+type MessageIterator struct {
+	rows *sqlx.Rows
+	msg  t.Message
+	err  error
+}
+
+// Next advances the iterator to the next message. Returns false when there are no more messages
+// or an error occurred. The rows are released automatically when the iteration is complete.
+func (it *MessageIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	if !it.rows.Next() {
+		it.err = it.rows.Err()
+		it.rows.Close()
+		return false
+	}
+	it.msg = t.Message{}
+	if it.err = it.rows.StructScan(&it.msg); it.err != nil {
+		it.rows.Close()
+		return false
+	}
+	it.msg.From = encodeUidString(it.msg.From).String()
+	it.msg.Content = fromJSON(it.msg.Content)
+	return true
+}
+
+// Scan copies the current message into msg.
+func (it *MessageIterator) Scan(msg *t.Message) error {
+	if it.err != nil {
+		return it.err
+	}
+	*msg = it.msg
+	return nil
+}
+
+// Err returns the error, if any, encountered during iteration.
+func (it *MessageIterator) Err() error {
+	return it.err
+}
+
+// Close releases the underlying rows and the connection. Safe to call more than once.
+func (it *MessageIterator) Close() error {
+	return it.rows.Close()
+}
+
+// MessageStream is the same as MessageGetAll but instead of loading all messages into memory
+// it returns an iterator which fetches them one by one. The caller must Close the iterator.
+func (a *adapter) MessageStream(ctx context.Context, topic string, forUser t.Uid,
+	opts *t.QueryOpt) (*MessageIterator, error) {
+	q, args := a.messageQuery(topic, forUser, opts)
+	rows, err := a.reader(ctx).QueryxContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &MessageIterator{rows: rows}, nil
+}
+
+// TopicMessageStats returns the number of messages stored in the topic, the total size of their
+// content in bytes and the maximum seq ID. The size is the length of the serialized JSON content,
+// i.e. an estimate of the storage used. Hard-deleted messages are counted but their content is not.
+func (a *adapter) TopicMessageStats(topic string) (count int, totalBytes int64, maxSeqId int, err error) {
+	err = a.db.QueryRowx("SELECT COUNT(*),COALESCE(SUM(LENGTH(content)),0),COALESCE(MAX(seqid),0) "+
+		"FROM messages WHERE topic=?", topic).Scan(&count, &totalBytes, &maxSeqId)
+	return
+}
+
+// dellogEntry is a row of the dellog table.
+type dellogEntry struct {
+	Topic      string
+	Deletedfor int64
+	Delid      int
+	Low        int
+	Hi         int
+}
+
+// CompactDelLog merges adjacent and overlapping ranges of deleted messages of the topic which belong
+// to the same deletion operation and user. Returns the number of removed dellog rows.
+func (a *adapter) CompactDelLog(topic string) (int, error) {
+	var removed int
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		removed = 0
+
+		var entries []dellogEntry
+		if err := tx.Select(&entries, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? "+
+			"ORDER BY deletedfor,delid,low FOR UPDATE", topic); err != nil {
+			return err
+		}
+
+		for start := 0; start < len(entries); {
+			end := start + 1
+			for end < len(entries) && entries[end].Deletedfor == entries[start].Deletedfor &&
+				entries[end].Delid == entries[start].Delid {
+				end++
+			}
+			group := entries[start:end]
+			start = end
+
+			ranges := make([]t.Range, len(group))
+			for i, e := range group {
+				ranges[i] = t.Range{Low: e.Low, Hi: e.Hi}
+			}
+			merged := mergeDelRanges(ranges)
+			if len(merged) == len(group) {
+				continue
+			}
+
+			if _, err := tx.Exec("DELETE FROM dellog WHERE topic=? AND deletedfor=? AND delid=?",
+				topic, group[0].Deletedfor, group[0].Delid); err != nil {
+				return err
+			}
+			for _, r := range merged {
+				if _, err := tx.Exec("INSERT INTO dellog(topic,deletedfor,delid,low,hi) VALUES(?,?,?,?,?)",
+					topic, group[0].Deletedfor, group[0].Delid, r.Low, r.Hi); err != nil {
+					return err
+				}
+			}
+			removed += len(group) - len(merged)
+		}
+		return nil
+	})
+	return removed, err
+}
+
+// mergeDelRanges merges adjacent and overlapping inclusive-exclusive [low, hi) ranges.
+// Returns the minimal set of ranges sorted by low.
+func mergeDelRanges(ranges []t.Range) []t.Range {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sorted := make([]t.Range, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Low < sorted[j].Low })
+
+	merged := []t.Range{sorted[0]}
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.Low <= last.Hi {
+			if r.Hi > last.Hi {
+				last.Hi = r.Hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// ReactionAdd saves user's reaction to a message. Returns t.ErrDuplicate if the user has already
+// left the same reaction on the message.
+func (a *adapter) ReactionAdd(msgId, user t.Uid, reaction string) error {
+	if msgId.IsZero() || user.IsZero() || reaction == "" {
+		return t.ErrMalformed
+	}
+	_, err := a.db.Exec("INSERT INTO msgreactions(createdat,msgid,userid,reaction) VALUES(?,?,?,?)",
+		t.TimeNow(), int64(msgId), store.DecodeUid(user), reaction)
+	if isDupe(err) {
+		return t.ErrDuplicate
+	}
+	return err
+}
+
+// ReactionRemove deletes user's reaction to a message. Removing a reaction which does not exist is not an error.
+func (a *adapter) ReactionRemove(msgId, user t.Uid, reaction string) error {
+	_, err := a.db.Exec("DELETE FROM msgreactions WHERE msgid=? AND userid=? AND reaction=?",
+		int64(msgId), store.DecodeUid(user), reaction)
+	return err
+}
+
+// ReactionsForMessages loads reactions to the given messages grouped by message ID. Reactions
+// of each message are ordered by the time they were left. Messages without reactions are not
+// included in the result.
+func (a *adapter) ReactionsForMessages(msgIds []t.Uid) (map[t.Uid][]t.Reaction, error) {
+	ids := make([]interface{}, 0, len(msgIds))
+	for _, id := range msgIds {
+		ids = append(ids, int64(id))
+	}
+
+	result := make(map[t.Uid][]t.Reaction)
+	for _, batch := range chunkArgs(ids, a.inBatchSize) {
+		q, batch, _ := sqlx.In("SELECT msgid,createdat,userid,reaction FROM msgreactions "+
+			"WHERE msgid IN (?) ORDER BY createdat,id", batch)
+		rows, err := a.db.Queryx(a.db.Rebind(q), batch...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var msgId int64
+			var userId int64
+			var r t.Reaction
+			if err = rows.Scan(&msgId, &r.CreatedAt, &userId, &r.Reaction); err != nil {
+				break
+			}
+			r.User = store.EncodeUid(userId).String()
+			result[t.Uid(msgId)] = append(result[t.Uid(msgId)], r)
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
 
+	return result, nil
 }
 
-// Messages
-func (a *adapter) MessageSave(msg *t.Message) error {
-	res, err := a.db.Exec(
-		"INSERT INTO messages(createdAt,updatedAt,seqid,topic,`from`,head,content) VALUES(?,?,?,?,?,?,?)",
-		msg.CreatedAt, msg.UpdatedAt, msg.SeqId, msg.Topic,
-		store.DecodeUid(t.ParseUid(msg.From)), msg.Head, toJSON(msg.Content))
-	if err == nil {
-		id, _ := res.LastInsertId()
-		msg.SetUid(t.Uid(id))
+// MessageUpdate replaces the headers and content of the message identified by topic and seqId.
+// If edit history is enabled, the prior version of the message is saved to msgedits first.
+// Deleted messages cannot be edited: t.ErrNotFound is returned.
+func (a *adapter) MessageUpdate(topic string, seqId int, head t.MessageHeaders, content interface{}) error {
+	if seqId <= 0 {
+		return t.ErrMalformed
+	}
+	newContent, err := toJSON(content)
+	if err != nil {
+		return err
 	}
-	return err
-}
-
-func (a *adapter) MessageGetAll(topic string, forUser t.Uid, opts *t.QueryOpt) ([]t.Message, error) {
-	var limit = a.maxResults
-	var lower = 0
-	var upper = 1 << 31
 
-	if opts != nil {
-		if opts.Since > 0 {
-			lower = opts.Since
+	return a.withTx(func(tx *sqlx.Tx) error {
+		var prior struct {
+			Id      int64
+			Head    []byte
+			Content []byte
 		}
-		if opts.Before > 0 {
-			// MySQL BETWEEN is inclusive-inclusive, Tinode API requires inclusive-exclusive, thus -1
-			upper = opts.Before - 1
+		err := tx.Get(&prior, "SELECT id,head,content FROM messages WHERE topic=? AND seqid=? AND delid=0 "+
+			"FOR UPDATE", topic, seqId)
+		if err == sql.ErrNoRows {
+			return t.ErrNotFound
+		}
+		if err != nil {
+			return err
 		}
 
-		if opts.Limit > 0 && opts.Limit < limit {
-			limit = opts.Limit
+		now := t.TimeNow()
+		if a.editHistory {
+			if _, err = tx.Exec("INSERT INTO msgedits(createdat,msgid,head,content) VALUES(?,?,?,?)",
+				now, prior.Id, prior.Head, prior.Content); err != nil {
+				return err
+			}
 		}
-	}
 
-	unum := store.DecodeUid(forUser)
-	rows, err := a.db.Queryx(
-		"SELECT m.createdat,m.updatedat,m.deletedat,m.delid,m.seqid,m.topic,m.`from`,m.head,m.content"+
-			" FROM messages AS m LEFT JOIN dellog AS d"+
-			" ON d.topic=m.topic AND m.seqid BETWEEN d.low AND d.hi AND d.deletedfor=?"+
-			" WHERE m.delid=0 AND m.topic=? AND m.seqid BETWEEN ? AND ? AND d.deletedfor IS NULL"+
-			" ORDER BY m.seqid DESC LIMIT ?",
-		unum, topic, lower, upper, limit)
+		_, err = tx.Exec("UPDATE messages SET updatedat=?,head=?,content=? WHERE id=?",
+			now, head, newContent, prior.Id)
+		return err
+	})
+}
 
+// MessageEditHistory returns prior versions of the message identified by topic and seqId,
+// oldest first. CreatedAt of each version is the time when it was replaced by an edit.
+func (a *adapter) MessageEditHistory(topic string, seqId int) ([]t.Message, error) {
+	rows, err := a.db.Queryx("SELECT me.createdat,m.seqid,m.topic,m.`from`,me.head,me.content "+
+		"FROM msgedits AS me INNER JOIN messages AS m ON m.id=me.msgid "+
+		"WHERE m.topic=? AND m.seqid=? AND m.delid=0 ORDER BY me.id", topic, seqId)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	var msgs []t.Message
+	var versions []t.Message
 	for rows.Next() {
 		var msg t.Message
-		if err = rows.StructScan(&msg); err != nil {
-			break
+		var from int64
+		var head, content []byte
+		if err = rows.Scan(&msg.CreatedAt, &msg.SeqId, &msg.Topic, &from, &head, &content); err != nil {
+			return nil, err
 		}
-		msg.From = encodeUidString(msg.From).String()
-		msg.Content = fromJSON(msg.Content)
-		msgs = append(msgs, msg)
+		if head != nil {
+			if err = json.Unmarshal(head, &msg.Head); err != nil {
+				return nil, err
+			}
+		}
+		msg.UpdatedAt = msg.CreatedAt
+		msg.From = store.EncodeUid(from).String()
+		msg.Content = fromJSON(content)
+		versions = append(versions, msg)
 	}
-	rows.Close()
-	return msgs, err
-}
-
-var dellog struct {
-	Topic      string
-	Deletedfor int64
-	Delid      int
-	Low        int
-	Hi         int
+	return versions, rows.Err()
 }
 
 // Get ranges of deleted messages
@@ -1919,44 +4036,40 @@ func (a *adapter) MessageGetDeleted(topic string, forUser t.Uid, opts *t.QueryOp
 	}
 
 	// Fetch log of deletions
-	rows, err := a.db.Queryx("SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? AND delid BETWEEN ? AND ?"+
+	var entries []dellogEntry
+	err := a.db.Select(&entries, "SELECT topic,deletedfor,delid,low,hi FROM dellog WHERE topic=? AND delid BETWEEN ? AND ?"+
 		" AND (deletedFor=0 OR deletedFor=?)"+
 		" ORDER BY delid LIMIT ?", topic, lower, upper, store.DecodeUid(forUser), limit)
 	if err != nil {
 		return nil, err
 	}
 
+	return groupDelLog(entries), nil
+}
+
+// groupDelLog converts dellog entries ordered by delid into a list of DelMessage, one per delid.
+func groupDelLog(entries []dellogEntry) []t.DelMessage {
 	var dmsgs []t.DelMessage
-	var dmsg t.DelMessage
-	for rows.Next() {
-		if err = rows.StructScan(&dellog); err != nil {
-			dmsgs = nil
-			break
-		}
-		if dellog.Delid != dmsg.DelId {
-			if dmsg.DelId > 0 {
-				dmsgs = append(dmsgs, dmsg)
+	for _, entry := range entries {
+		if len(dmsgs) == 0 || dmsgs[len(dmsgs)-1].DelId != entry.Delid {
+			dmsg := t.DelMessage{
+				Topic:       entry.Topic,
+				DelId:       entry.Delid,
+				SeqIdRanges: []t.Range{},
 			}
-			dmsg.DelId = dellog.Delid
-			dmsg.Topic = dellog.Topic
-			if dellog.Deletedfor > 0 {
-				dmsg.DeletedFor = store.EncodeUid(dellog.Deletedfor).String()
-			}
-			if dmsg.SeqIdRanges == nil {
-				dmsg.SeqIdRanges = []t.Range{}
+			if entry.Deletedfor > 0 {
+				dmsg.DeletedFor = store.EncodeUid(entry.Deletedfor).String()
 			}
+			dmsgs = append(dmsgs, dmsg)
 		}
-		if dellog.Hi <= dellog.Low+1 {
-			dellog.Hi = 0
+		// Ranges of a single message are returned with Hi=0.
+		if entry.Hi <= entry.Low+1 {
+			entry.Hi = 0
 		}
-		dmsg.SeqIdRanges = append(dmsg.SeqIdRanges, t.Range{dellog.Low, dellog.Hi})
-	}
-	if dmsg.DelId > 0 {
-		dmsgs = append(dmsgs, dmsg)
+		last := &dmsgs[len(dmsgs)-1]
+		last.SeqIdRanges = append(last.SeqIdRanges, t.Range{Low: entry.Low, Hi: entry.Hi})
 	}
-	rows.Close()
-
-	return dmsgs, err
+	return dmsgs
 }
 
 func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
@@ -1967,10 +4080,26 @@ func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 		if err == nil {
 			_, err = tx.Exec("DELETE FROM messages WHERE topic=?", topic)
 		}
-		// filemsglinks will be deleted because of ON DELETE CASCADE
+		// filemsglinks, msgreactions and msgedits will be deleted because of ON DELETE CASCADE
 
 	} else {
-		// Only some messages are being deleted
+		// Only some messages are being deleted.
+		if len(toDel.SeqIdRanges) == 0 {
+			return t.ErrMalformed
+		}
+		if toDel.DeletedFor == "" {
+			// Make sure hard-deleted ranges refer to existing messages, otherwise dellog is filled with junk.
+			where, args := seqRangesWhere("seqid", toDel.SeqIdRanges)
+			var count int
+			if err = tx.Get(&count, "SELECT COUNT(*) FROM messages WHERE topic=? AND deletedat IS NULL AND "+where,
+				append([]interface{}{topic}, args...)...); err != nil {
+				return err
+			}
+			if count == 0 {
+				return t.ErrMalformed
+			}
+		}
+
 		// Start with making log entries
 		forUser := decodeUidString(toDel.DeletedFor)
 		var insert *sql.Stmt
@@ -2022,76 +4151,96 @@ func messageDeleteList(tx *sqlx.Tx, topic string, toDel *t.DelMessage) error {
 				return err
 			}
 
+			_, err = tx.Exec("DELETE mr.* FROM msgreactions AS mr INNER JOIN messages AS m ON m.id=mr.msgid WHERE "+
+				where, args...)
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.Exec("DELETE me.* FROM msgedits AS me INNER JOIN messages AS m ON m.id=me.msgid WHERE "+
+				where, args...)
+			if err != nil {
+				return err
+			}
+
 			_, err = tx.Exec("UPDATE messages AS m SET m.deletedAt=?,m.delId=?,m.head=NULL,m.content=NULL WHERE "+
 				where,
 				append([]interface{}{t.TimeNow(), toDel.DelId}, args...)...)
+			if err != nil {
+				return err
+			}
+
+			// Don't keep the preview of a deleted message.
+			previewWhere, previewArgs := seqRangesWhere("CAST(JSON_EXTRACT(lastmsg,'$.seq') AS SIGNED)", toDel.SeqIdRanges)
+			_, err = tx.Exec("UPDATE topics SET lastmsg=NULL WHERE name=? AND lastmsg IS NOT NULL AND "+previewWhere,
+				append([]interface{}{topic}, previewArgs...)...)
 		}
 	}
 
 	return err
 }
 
-// MessageDeleteList deletes messages in the given topic with seqIds from the list
-func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) (err error) {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+// seqRangesWhere builds a condition matching values of the seqid expression in any of the given ranges.
+func seqRangesWhere(seqid string, ranges []t.Range) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	for _, r := range ranges {
+		if r.Hi == 0 {
+			conds = append(conds, seqid+"=?")
+			args = append(args, r.Low)
+		} else {
+			// MySQL's BETWEEN is inclusive-inclusive thus decrement Hi by 1.
+			conds = append(conds, seqid+" BETWEEN ? AND ?")
+			args = append(args, r.Low, r.Hi-1)
 		}
-	}()
-
-	if err = messageDeleteList(tx, topic, toDel); err != nil {
-		return err
 	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
 
-	return tx.Commit()
+// MessageDeleteList deletes messages in the given topic with seqIds from the list.
+// Returns t.ErrMalformed if none of the messages exist.
+func (a *adapter) MessageDeleteList(topic string, toDel *t.DelMessage) error {
+	return a.withRetry(func() error {
+		return a.deleteMessageList(topic, toDel)
+	})
+}
+
+func (a *adapter) deleteMessageList(topic string, toDel *t.DelMessage) error {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		return messageDeleteList(tx, topic, toDel)
+	})
 }
 
 // MessageAttachments connects given message to a list of file record IDs.
 func (a *adapter) MessageAttachments(msgId t.Uid, fids []string) error {
 	var args []interface{}
 	var values []string
-	strNow := t.TimeNow().Format("2006-01-02T15:04:05.999")
-	// createdat,fileid,msgid
-	val := "VALUES('" + strNow + "',?," + strconv.FormatInt(int64(msgId), 10) + ")"
+	var ids []interface{}
+	now := t.TimeNow()
 	for _, fid := range fids {
 		id := t.ParseUid(fid)
 		if id.IsZero() {
 			return t.ErrMalformed
 		}
-		values = append(values, val)
-		args = append(args, store.DecodeUid(id))
+		// createdat,fileid,msgid
+		values = append(values, "(?,?,?)")
+		args = append(args, now, store.DecodeUid(id), int64(msgId))
+		ids = append(ids, store.DecodeUid(id))
 	}
-	if len(args) == 0 {
+	if len(ids) == 0 {
 		return t.ErrMalformed
 	}
 
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
+	return a.withTx(func(tx *sqlx.Tx) error {
+		_, err := tx.Exec("INSERT INTO filemsglinks(createdat,fileid,msgid) VALUES "+strings.Join(values, ","), args...)
 		if err != nil {
-			tx.Rollback()
+			return err
 		}
-	}()
-
-	_, err = a.db.Exec("INSERT INTO filemsglinks(createdat,fileid,msgid) "+strings.Join(values, ","), args...)
-	if err != nil {
-		return err
-	}
 
-	_, err = tx.Exec("UPDATE fileuploads SET updatedat='"+strNow+"' WHERE id IN (?"+
-		strings.Repeat(",?", len(args)-1)+")", args...)
-	if err != nil {
+		query, ids, _ := sqlx.In("UPDATE fileuploads SET updatedat=? WHERE id IN (?)", now, ids)
+		_, err = tx.Exec(query, ids...)
 		return err
-	}
-
-	return tx.Commit()
+	})
 }
 
 func deviceHasher(deviceID string) string {
@@ -2104,32 +4253,54 @@ func deviceHasher(deviceID string) string {
 
 // Device management for push notifications
 func (a *adapter) DeviceUpsert(uid t.Uid, def *t.DeviceDef) error {
+	_, _, err := a.DeviceReplace(uid, def)
+	return err
+}
+
+// DeviceReplace is the same as DeviceUpsert but it also reports what has changed: the ID of
+// the user who previously held the device if the device has moved from another user or t.ZeroUid,
+// and true if the device is new, false if an existing record was updated.
+func (a *adapter) DeviceReplace(uid t.Uid, def *t.DeviceDef) (t.Uid, bool, error) {
+	var prevOwner t.Uid
+	var inserted bool
+	err := a.withRetry(func() (err error) {
+		prevOwner, inserted, err = a.deviceReplace(uid, def)
+		return
+	})
+	return prevOwner, inserted, err
+}
+
+func (a *adapter) deviceReplace(uid t.Uid, def *t.DeviceDef) (t.Uid, bool, error) {
 	hash := deviceHasher(def.DeviceId)
+	decoded_uid := store.DecodeUid(uid)
 
-	tx, err := a.db.Begin()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
+	var prevOwner int64
+	var inserted bool
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		// Find out who has the device now. Lock the record so the owner cannot change before the update.
+		err := tx.Get(&prevOwner, "SELECT userid FROM devices WHERE hash=? FOR UPDATE", hash)
+		if err == sql.ErrNoRows {
+			inserted = true
+		} else if err != nil {
+			return err
 		}
-	}()
 
-	// Ensure uniqueness of the device ID: delete all records of the device ID
-	_, err = tx.Exec("DELETE FROM devices WHERE hash=?", hash)
-	if err != nil {
+		// Device ID is unique: add the device or move the existing record to the new user.
+		_, err = tx.Exec("INSERT INTO devices(userid, hash, deviceId, platform, lastseen, lang) VALUES(?,?,?,?,?,?) "+
+			"ON DUPLICATE KEY UPDATE userid=VALUES(userid),deviceid=VALUES(deviceid),platform=VALUES(platform),"+
+			"lastseen=VALUES(lastseen),lang=VALUES(lang)",
+			decoded_uid, hash, def.DeviceId, def.Platform, def.LastSeen, def.Lang)
 		return err
-	}
-
-	// Actually add/update DeviceId for the new user
-	_, err = tx.Exec("INSERT INTO devices(userid, hash, deviceId, platform, lastseen, lang) VALUES(?,?,?,?,?,?)",
-		store.DecodeUid(uid), hash, def.DeviceId, def.Platform, def.LastSeen, def.Lang)
+	})
 	if err != nil {
-		return err
+		return t.ZeroUid, false, err
 	}
 
-	return tx.Commit()
+	if prevOwner == decoded_uid {
+		// Same user, the device has not moved.
+		prevOwner = 0
+	}
+	return store.EncodeUid(prevOwner), inserted, nil
 }
 
 func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, error) {
@@ -2174,6 +4345,86 @@ func (a *adapter) DeviceGetAll(uids ...t.Uid) (map[t.Uid][]t.DeviceDef, int, err
 	return result, count, err
 }
 
+// DevicesByLang loads devices of the given users grouped by device language. Devices without
+// a language are returned under the empty key.
+func (a *adapter) DevicesByLang(uids ...t.Uid) (map[string][]t.DeviceDef, error) {
+	var unums []interface{}
+	for _, uid := range uids {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+
+	var device struct {
+		Deviceid string
+		Platform string
+		Lastseen time.Time
+		Lang     string
+	}
+
+	result := make(map[string][]t.DeviceDef)
+	for _, batch := range chunkArgs(unums, a.inBatchSize) {
+		q, batch, _ := sqlx.In("SELECT deviceid,platform,lastseen,COALESCE(lang,'') AS lang FROM devices "+
+			"WHERE userid IN (?)", batch)
+		rows, err := a.db.Queryx(q, batch...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			if err = rows.StructScan(&device); err != nil {
+				break
+			}
+			result[device.Lang] = append(result[device.Lang], t.DeviceDef{
+				DeviceId: device.Deviceid,
+				Platform: device.Platform,
+				LastSeen: device.Lastseen,
+				Lang:     device.Lang,
+			})
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// DeviceCountByPlatform returns the number of devices of the given users by platform.
+// Devices without a platform are counted under "unknown".
+func (a *adapter) DeviceCountByPlatform(uids ...t.Uid) (map[string]int, error) {
+	var unums []interface{}
+	for _, uid := range uids {
+		unums = append(unums, store.DecodeUid(uid))
+	}
+
+	result := make(map[string]int)
+	for _, batch := range chunkArgs(unums, a.inBatchSize) {
+		q, batch, _ := sqlx.In("SELECT COALESCE(NULLIF(platform,''),'unknown') AS pl,COUNT(*) FROM devices "+
+			"WHERE userid IN (?) GROUP BY pl", batch)
+		rows, err := a.db.Query(q, batch...)
+		if err != nil {
+			return nil, err
+		}
+
+		var platform string
+		var count int
+		for rows.Next() {
+			if err = rows.Scan(&platform, &count); err != nil {
+				break
+			}
+			result[platform] += count
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
 func deviceDelete(tx *sqlx.Tx, uid t.Uid, deviceID string) error {
 	var err error
 	if deviceID == "" {
@@ -2185,22 +4436,9 @@ func deviceDelete(tx *sqlx.Tx, uid t.Uid, deviceID string) error {
 }
 
 func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	err = deviceDelete(tx, uid, deviceID)
-	if err != nil {
-		return err
-	}
-
-	return tx.Commit()
+	return a.withTx(func(tx *sqlx.Tx) error {
+		return deviceDelete(tx, uid, deviceID)
+	})
 }
 
 // Credential management
@@ -2215,84 +4453,94 @@ func (a *adapter) DeviceDelete(uid t.Uid, deviceID string) error {
 // 2.3 Undelete existing credential. Return if successful.
 // 2.4 Insert new credential record.
 func (a *adapter) CredUpsert(cred *t.Credential) (bool, error) {
-	var err error
-
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return false, err
-	}
-	defer func() {
-		if err != nil {
-			log.Println("Rollback")
-			tx.Rollback()
-		}
-	}()
+	var inserted bool
+	err := a.withRetry(func() (err error) {
+		inserted, err = a.credUpsert(cred)
+		return
+	})
+	return inserted, err
+}
 
+func (a *adapter) credUpsert(cred *t.Credential) (bool, error) {
 	now := t.TimeNow()
 	userId := decodeUidString(cred.User)
 
-	// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
-	// if credential is not yet confirmed, "userid:method:value" is unique.
-	synth := cred.Method + ":" + cred.Value
-
-	if !cred.Done {
-		// Check if this credential is already validated.
-		var done bool
-		err = tx.Get(&done, "SELECT done FROM credentials WHERE synthetic=?", synth)
-		if err == nil {
-			return false, t.ErrDuplicate
-		}
-		if err != sql.ErrNoRows {
-			return false, err
-		}
-		// We are going to insert new record.
-		synth = cred.User + ":" + synth
+	var inserted bool
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		// Enforce uniqueness: if credential is confirmed, "method:value" must be unique.
+		// if credential is not yet confirmed, "userid:method:value" is unique.
+		synth := cred.Method + ":" + cred.Value
+
+		if !cred.Done {
+			// Check if this credential is already validated.
+			var done bool
+			err := tx.Get(&done, "SELECT done FROM credentials WHERE synthetic=?", synth)
+			if err == nil {
+				return t.ErrDuplicate
+			}
+			if err != sql.ErrNoRows {
+				return err
+			}
+			// We are going to insert new record.
+			synth = cred.User + ":" + synth
 
-		// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
-		_, err = tx.Exec("UPDATE credentials SET deletedat=? WHERE userid=? AND method=? AND done=false",
-			now, userId, cred.Method)
-		// Assume that the record exists and try to update it: undelete, update timestamp and response value.
-		res, err := tx.Exec("UPDATE credentials SET updatedat=?,deletedat=NULL,resp=?,done=0 WHERE synthetic=?",
-			cred.UpdatedAt, cred.Resp, synth)
-		if err != nil {
-			return false, err
-		}
-		// If record was updated, then all is fine.
-		if numrows, _ := res.RowsAffected(); numrows > 0 {
-			return false, tx.Commit()
-		}
-	} else {
-		// Hard-deleting unconformed record if it exists.
-		_, err = tx.Exec("DELETE FROM credentials WHERE synthetic=?", cred.User+":"+synth)
-		if err != nil {
-			return false, err
+			// Adding new unvalidated credential. Deactivate all unvalidated records of this user and method.
+			_, err = tx.Exec("UPDATE credentials SET deletedat=? WHERE userid=? AND method=? AND done=false",
+				now, userId, cred.Method)
+			if err != nil {
+				return err
+			}
+			// Assume that the record exists and try to update it: undelete, update timestamp and response value.
+			res, err := tx.Exec("UPDATE credentials SET updatedat=?,deletedat=NULL,resp=?,done=false WHERE synthetic=?",
+				cred.UpdatedAt, cred.Resp, synth)
+			if err != nil {
+				return err
+			}
+			// If record was updated, then all is fine.
+			if numrows, _ := res.RowsAffected(); numrows > 0 {
+				return nil
+			}
+		} else {
+			// Hard-deleting unconformed record if it exists.
+			if _, err := tx.Exec("DELETE FROM credentials WHERE synthetic=?", cred.User+":"+synth); err != nil {
+				return err
+			}
 		}
-	}
-	// Add new record.
-	_, err = tx.Exec("INSERT INTO credentials(createdat,updatedat,method,value,synthetic,userid,resp,done) "+
-		"VALUES(?,?,?,?,?,?,?,?)",
-		cred.CreatedAt, cred.UpdatedAt, cred.Method, cred.Value, synth, userId, cred.Resp, cred.Done)
-	if err != nil {
+		// Add new record.
+		inserted = true
+		_, err := tx.Exec("INSERT INTO credentials(createdat,updatedat,method,value,synthetic,userid,resp,done) "+
+			"VALUES(?,?,?,?,?,?,?,?)",
+			cred.CreatedAt, cred.UpdatedAt, cred.Method, cred.Value, synth, userId, cred.Resp, cred.Done)
 		if isDupe(err) {
-			return true, t.ErrDuplicate
+			return t.ErrDuplicate
 		}
-		return true, err
-	}
-	return true, tx.Commit()
+		return err
+	})
+
+	return inserted, err
 }
 
 // CredIsConfirmed returns true of the given validation method is confirmed.
 func (a *adapter) CredIsConfirmed(uid t.Uid, method string) (bool, error) {
-	var done int
+	var done bool
 	// There could be more than one credential of the same method. We just need one.
-	err := a.db.Get(&done, "SELECT done FROM credentials WHERE userid=? AND method=? AND done=true",
+	err := a.db.Get(&done, "SELECT done FROM credentials WHERE userid=? AND method=? AND done=true LIMIT 1",
 		store.DecodeUid(uid), method)
 	if err == sql.ErrNoRows {
 		// Nothing found, clear the error, otherwise it will be reported as internal error.
 		err = nil
 	}
 
-	return done > 0, err
+	return done, err
+}
+
+// CredConfirmedMethods returns names of the validation methods confirmed for the given user,
+// sorted alphabetically.
+func (a *adapter) CredConfirmedMethods(uid t.Uid) ([]string, error) {
+	var methods []string
+	err := a.db.Select(&methods, "SELECT DISTINCT method FROM credentials WHERE userid=? AND done=true "+
+		"ORDER BY method", store.DecodeUid(uid))
+	return methods, err
 }
 
 // credDel deletes given validation method or all methods of the given user.
@@ -2301,7 +4549,8 @@ func (a *adapter) CredIsConfirmed(uid t.Uid, method string) (bool, error) {
 // 2.1 Delete it if it's valiated or if there were no attempts at validation
 // (otherwise it could be used to circumvent the limit on validation attempts).
 // 2.2 In that case mark it as soft-deleted.
-func credDel(tx *sqlx.Tx, uid t.Uid, method, value string) error {
+// Returns the number of hard- and soft-deleted records.
+func credDel(tx *sqlx.Tx, uid t.Uid, method, value string) (int, error) {
 	constraints := " WHERE userid=?"
 	args := []interface{}{store.DecodeUid(uid)}
 
@@ -2316,42 +4565,52 @@ func credDel(tx *sqlx.Tx, uid t.Uid, method, value string) error {
 	}
 
 	if method == "" {
-		_, err := tx.Exec("DELETE FROM credentials"+constraints, args...)
-		return err
+		res, err := tx.Exec("DELETE FROM credentials"+constraints, args...)
+		if err != nil {
+			return 0, err
+		}
+		count, err := res.RowsAffected()
+		return int(count), err
 	}
 
 	// Case 2.1
-	if _, err := tx.Exec("DELETE FROM credentials"+constraints+" AND (done=true OR retries=0)", args...); err != nil {
-		return err
+	res, err := tx.Exec("DELETE FROM credentials"+constraints+" AND (done=true OR retries=0)", args...)
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
 	}
 
-	// Case 2.2
+	// Case 2.2. Records which are already soft-deleted are not counted.
 	args = append([]interface{}{t.TimeNow()}, args...)
-	_, err := tx.Exec("UPDATE credentials SET deletedat=?"+constraints, args...)
+	res, err = tx.Exec("UPDATE credentials SET deletedat=?"+constraints+" AND deletedat IS NULL", args...)
+	if err != nil {
+		return 0, err
+	}
+	softDeleted, err := res.RowsAffected()
 
-	return err
+	return int(deleted + softDeleted), err
 }
 
 // CredDel deletes either credentials of the given user. If method is blank all
 // credentials are removed. If value is blank all credentials of the given the
 // method are removed.
 func (a *adapter) CredDel(uid t.Uid, method, value string) error {
-	tx, err := a.db.Beginx()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
-
-	err = credDel(tx, uid, method, value)
-	if err != nil {
-		return err
-	}
+	_, err := a.CredDelCount(uid, method, value)
+	return err
+}
 
-	return tx.Commit()
+// CredDelCount is the same as CredDel but it also returns the number of deleted credentials.
+// Zero means there was nothing to delete.
+func (a *adapter) CredDelCount(uid t.Uid, method, value string) (int, error) {
+	var count int
+	err := a.withTx(func(tx *sqlx.Tx) (err error) {
+		count, err = credDel(tx, uid, method, value)
+		return
+	})
+	return count, err
 }
 
 // CredConfirm marks given credential method as confirmed.
@@ -2380,10 +4639,13 @@ func (a *adapter) CredFail(uid t.Uid, method string) error {
 }
 
 // CredGetActive returns currently active unvalidated credential of the given user and method.
+// If more than one active record exists, the most recently updated one is returned. Credentials
+// have no expiration time, so stale records are not skipped: the validator decides what to do with them.
 func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error) {
 	var cred t.Credential
 	err := a.db.Get(&cred, "SELECT createdat,updatedat,method,value,resp,done,retries "+
-		"FROM credentials WHERE userid=? AND deletedat IS NULL AND method=? AND done=false",
+		"FROM credentials WHERE userid=? AND deletedat IS NULL AND method=? AND done=false "+
+		"ORDER BY updatedat DESC,createdat DESC LIMIT 1",
 		store.DecodeUid(uid), method)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -2397,6 +4659,7 @@ func (a *adapter) CredGetActive(uid t.Uid, method string) (*t.Credential, error)
 }
 
 // CredGetAll returns credential records for the given user and method, all or validated only.
+// The most recently updated records are returned first.
 func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.Credential, error) {
 	query := "SELECT createdat,updatedat,method,value,resp,done,retries FROM credentials WHERE userid=? AND deletedat IS NULL"
 	args := []interface{}{store.DecodeUid(uid)}
@@ -2407,6 +4670,7 @@ func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.
 	if validatedOnly {
 		query += " AND done=true"
 	}
+	query += " ORDER BY updatedat DESC,createdat DESC"
 
 	var credentials []t.Credential
 	err := a.db.Select(&credentials, query, args...)
@@ -2425,20 +4689,30 @@ func (a *adapter) CredGetAll(uid t.Uid, method string, validatedOnly bool) ([]t.
 // FileUploads
 
 // FileStartUpload initializes a file upload
+// Starting the same upload again is a no-op, so that the request can be retried.
+// The file id must be assigned by the caller: t.ErrMalformed is returned for a zero id.
 func (a *adapter) FileStartUpload(fd *t.FileDef) error {
+	if fd.Uid().IsZero() {
+		return t.ErrMalformed
+	}
 	_, err := a.db.Exec("INSERT INTO fileuploads(id,createdat,updatedat,userid,status,mimetype,size,location)"+
-		" VALUES(?,?,?,?,?,?,?,?)",
+		" VALUES(?,?,?,?,?,?,?,?) ON DUPLICATE KEY UPDATE id=id",
 		store.DecodeUid(fd.Uid()), fd.CreatedAt, fd.UpdatedAt,
 		store.DecodeUid(t.ParseUid(fd.User)), fd.Status, fd.MimeType, fd.Size, fd.Location)
 	return err
 }
 
-// FileFinishUpload marks file upload as completed, successfully or otherwise
+// FileFinishUpload marks file upload as completed, successfully or otherwise.
+// Only uploads which have been started can be finished: t.ErrConflict is returned if the upload
+// has already finished with a different status. Finishing with the same status is a no-op.
 func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileDef, error) {
 	id := t.ParseUid(fid)
 	if id.IsZero() {
 		return nil, t.ErrMalformed
 	}
+	if status != t.UploadCompleted && status != t.UploadFailed {
+		return nil, t.ErrMalformed
+	}
 
 	fd, err := a.FileGet(fid)
 	if err != nil {
@@ -2447,17 +4721,29 @@ func (a *adapter) FileFinishUpload(fid string, status int, size int64) (*t.FileD
 	if fd == nil {
 		return nil, t.ErrNotFound
 	}
+	if fd.Status == status {
+		// Replayed request.
+		return fd, nil
+	}
+	if fd.Status != t.UploadStarted {
+		return nil, t.ErrConflict
+	}
 
-	fd.UpdatedAt = t.TimeNow()
-	_, err = a.db.Exec("UPDATE fileuploads SET updatedat=?,status=?,size=? WHERE id=?",
-		fd.UpdatedAt, status, size, store.DecodeUid(id))
-	if err == nil {
-		fd.Status = status
-		fd.Size = size
-	} else {
-		fd = nil
+	updatedAt := t.TimeNow()
+	// Status is checked again in case the upload was finished concurrently.
+	res, err := a.db.Exec("UPDATE fileuploads SET updatedat=?,status=?,size=? WHERE id=? AND status=?",
+		updatedAt, status, size, store.DecodeUid(id), t.UploadStarted)
+	if err != nil {
+		return nil, err
+	}
+	if count, _ := res.RowsAffected(); count == 0 {
+		return nil, t.ErrConflict
 	}
-	return fd, err
+
+	fd.UpdatedAt = updatedAt
+	fd.Status = status
+	fd.Size = size
+	return fd, nil
 }
 
 // FileGet fetches a record of a specific file
@@ -2484,18 +4770,76 @@ func (a *adapter) FileGet(fid string) (*t.FileDef, error) {
 
 }
 
+// FileGetAll fetches records of multiple files in one query. Records are returned in the order of fids.
+// IDs of files which do not exist are skipped. Returns t.ErrMalformed if any of the IDs is invalid.
+func (a *adapter) FileGetAll(fids ...string) ([]*t.FileDef, error) {
+	ids := make([]interface{}, 0, len(fids))
+	for _, fid := range fids {
+		id := t.ParseUid(fid)
+		if id.IsZero() {
+			return nil, t.ErrMalformed
+		}
+		ids = append(ids, store.DecodeUid(id))
+	}
+
+	found := make(map[string]*t.FileDef, len(fids))
+	for _, batch := range chunkArgs(ids, a.inBatchSize) {
+		q, batch, _ := sqlx.In("SELECT id,createdat,updatedat,userid AS user,status,mimetype,size,location "+
+			"FROM fileuploads WHERE id IN (?)", batch)
+		rows, err := a.db.Queryx(a.db.Rebind(q), batch...)
+		if err != nil {
+			return nil, err
+		}
+
+		for rows.Next() {
+			var fd t.FileDef
+			if err = rows.StructScan(&fd); err != nil {
+				break
+			}
+			fd.Id = encodeUidString(fd.Id).String()
+			fd.User = encodeUidString(fd.User).String()
+			found[fd.Id] = &fd
+		}
+		rows.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*t.FileDef, 0, len(found))
+	for _, fid := range fids {
+		fid = t.ParseUid(fid).String()
+		if fd, ok := found[fid]; ok {
+			result = append(result, fd)
+			// Skip duplicate IDs.
+			delete(found, fid)
+		}
+	}
+
+	return result, nil
+}
+
 // FileDeleteUnused deletes file upload records.
 func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, error) {
-	tx, err := a.db.Begin()
+	var locations []string
+	err := a.withTx(func(tx *sqlx.Tx) error {
+		ids, locs, err := selectUnusedFiles(tx, olderThan, limit)
+		if err != nil || len(ids) == 0 {
+			return err
+		}
+		locations, err = deleteUnusedFiles(tx, ids, locs)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if err != nil {
-			tx.Rollback()
-		}
-	}()
 
+	return locations, nil
+}
+
+// selectUnusedFiles returns IDs and locations of file uploads not linked to any message.
+func selectUnusedFiles(tx *sqlx.Tx, olderThan time.Time, limit int) ([]int64, []string, error) {
 	query := "SELECT fu.id,fu.location FROM fileuploads AS fu LEFT JOIN filemsglinks AS fml ON fml.fileid=fu.id WHERE fml.id IS NULL "
 	var args []interface{}
 	if !olderThan.IsZero() {
@@ -2503,45 +4847,265 @@ func (a *adapter) FileDeleteUnused(olderThan time.Time, limit int) ([]string, er
 		args = append(args, olderThan)
 	}
 	if limit > 0 {
-		query += "LIMIT ?"
+		query += "LIMIT ? "
 		args = append(args, limit)
 	}
+	// Lock the selected rows until the transaction ends: a concurrent MessageAttachments
+	// cannot link a file which is about to be deleted.
+	query += "FOR UPDATE"
 
 	rows, err := tx.Query(query, args...)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
+	var ids []int64
 	var locations []string
-	var ids []interface{}
 	for rows.Next() {
-		var id int
+		var id int64
 		var loc string
 		if err = rows.Scan(&id, &loc); err != nil {
 			break
 		}
-		locations = append(locations, loc)
 		ids = append(ids, id)
+		locations = append(locations, loc)
 	}
 	rows.Close()
 
-	if err != nil {
+	return ids, locations, err
+}
+
+// deleteUnusedFiles deletes the file uploads selected by selectUnusedFiles. Files which have been linked
+// to a message since they were selected are not deleted. Returns locations of the deleted files.
+func deleteUnusedFiles(tx *sqlx.Tx, ids []int64, locations []string) ([]string, error) {
+	query, args, _ := sqlx.In("DELETE FROM fileuploads WHERE id IN (?) AND NOT EXISTS "+
+		"(SELECT 1 FROM filemsglinks AS fml WHERE fml.fileid=fileuploads.id)", ids)
+	if _, err := tx.Exec(query, args...); err != nil {
 		return nil, err
 	}
 
-	if len(ids) > 0 {
-		query, ids, _ = sqlx.In("DELETE FROM fileuploads WHERE id IN (?)", ids)
-		_, err = tx.Exec(query, ids...)
+	// Files which survived the delete are still in the table.
+	var kept []int64
+	query, args, _ = sqlx.In("SELECT id FROM fileuploads WHERE id IN (?)", ids)
+	if err := tx.Select(&kept, query, args...); err != nil {
+		return nil, err
+	}
+	if len(kept) == 0 {
+		return locations, nil
+	}
+
+	skip := make(map[int64]bool, len(kept))
+	for _, id := range kept {
+		skip[id] = true
+	}
+	var deleted []string
+	for i, id := range ids {
+		if !skip[id] {
+			deleted = append(deleted, locations[i])
+		}
+	}
+	return deleted, nil
+}
+
+// Bulk import. Used when migrating data from another adapter. Records are inserted with
+// their original IDs using multi-row inserts. If fast is true, foreign key and unique checks
+// are disabled for the duration of the import: the data must be known to be consistent.
+
+// UserImportAll inserts users and their tags.
+func (a *adapter) UserImportAll(users []*t.User, fast bool) error {
+	var rows, tags [][]interface{}
+	for _, user := range users {
+		jpub, err := toJSON(user.Public)
 		if err != nil {
-			return nil, err
+			return err
+		}
+		id := store.DecodeUid(user.Uid())
+		rows = append(rows, []interface{}{id, user.CreatedAt, user.UpdatedAt, user.DeletedAt, user.State,
+			user.Access, user.LastSeen, user.UserAgent, jpub, user.Tags})
+		for _, tag := range user.Tags {
+			tags = append(tags, []interface{}{id, tag})
+		}
+	}
+
+	return a.importTx(fast, func(tx *sqlx.Tx) error {
+		if err := bulkInsert(tx, "users", []string{"id", "createdat", "updatedat", "deletedat", "state",
+			"access", "lastseen", "useragent", "public", "tags"}, rows); err != nil {
+			return err
+		}
+		return bulkInsert(tx, "usertags", []string{"userid", "tag"}, tags)
+	})
+}
+
+// SubImportAll inserts subscriptions.
+func (a *adapter) SubImportAll(subs []*t.Subscription, fast bool) error {
+	var rows [][]interface{}
+	for _, sub := range subs {
+		jpriv, err := toJSON(sub.Private)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []interface{}{sub.CreatedAt, sub.UpdatedAt, sub.DeletedAt,
+			store.DecodeUid(t.ParseUid(sub.User)), sub.Topic, sub.DelId, sub.RecvSeqId, sub.ReadSeqId,
+			sub.ModeWant.String(), sub.ModeGiven.String(), jpriv})
+	}
+
+	return a.importTx(fast, func(tx *sqlx.Tx) error {
+		return bulkInsert(tx, "subscriptions", []string{"createdat", "updatedat", "deletedat", "userid", "topic",
+			"delid", "recvseqid", "readseqid", "modewant", "modegiven", "private"}, rows)
+	})
+}
+
+// MessageImportAll inserts messages.
+func (a *adapter) MessageImportAll(msgs []*t.Message, fast bool) error {
+	var rows [][]interface{}
+	for _, msg := range msgs {
+		content, err := toJSON(msg.Content)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, []interface{}{int64(msg.Uid()), msg.CreatedAt, msg.UpdatedAt, msg.DeletedAt,
+			msg.DelId, msg.SeqId, msg.Topic, store.DecodeUid(t.ParseUid(msg.From)), msg.Head, content})
+	}
+
+	return a.importTx(fast, func(tx *sqlx.Tx) error {
+		return bulkInsert(tx, "messages", []string{"id", "createdat", "updatedat", "deletedat",
+			"delid", "seqid", "topic", "`from`", "head", "content"}, rows)
+	})
+}
+
+// importTx runs fn in a transaction on a dedicated connection. If fast is true, the checks are
+// disabled on the connection and restored before it's returned to the pool. If the checks cannot
+// be restored, the connection is discarded.
+func (a *adapter) importTx(fast bool, fn func(tx *sqlx.Tx) error) (err error) {
+	ctx := context.Background()
+	conn, err := a.db.Connx(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if fast {
+		defer func() {
+			// Fresh context: the checks must be restored even if the import was cancelled.
+			if _, rerr := conn.ExecContext(context.Background(), "SET foreign_key_checks=1,unique_checks=1"); rerr != nil {
+				discardConn(conn.Conn)
+				if err == nil {
+					err = rerr
+				}
+			}
+		}()
+		if _, err = conn.ExecContext(ctx, "SET foreign_key_checks=0,unique_checks=0"); err != nil {
+			return err
+		}
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err = fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// discardConn closes the underlying connection instead of returning it to the pool, e.g. when
+// session settings could not be restored.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+}
+
+// bulkInsert inserts rows into the table in batches which fit into the limit on the number
+// of placeholders.
+func bulkInsert(tx *sqlx.Tx, table string, cols []string, rows [][]interface{}) error {
+	batchSize := maxInBatchSize / len(cols)
+	for len(rows) > 0 {
+		batch := rows
+		if len(batch) > batchSize {
+			batch = batch[:batchSize]
+		}
+		rows = rows[len(batch):]
+
+		args := make([]interface{}, 0, len(batch)*len(cols))
+		for _, row := range batch {
+			args = append(args, row...)
+		}
+		if _, err := tx.Exec(bulkInsertQuery(table, cols, len(batch)), args...); err != nil {
+			if isDupe(err) {
+				return t.ErrDuplicate
+			}
+			return err
 		}
 	}
+	return nil
+}
 
-	return locations, tx.Commit()
+// bulkInsertQuery builds a multi-row INSERT of count rows.
+func bulkInsertQuery(table string, cols []string, count int) string {
+	row := "(?" + strings.Repeat(",?", len(cols)-1) + ")"
+	return "INSERT INTO " + table + "(" + strings.Join(cols, ",") + ") VALUES " +
+		row + strings.Repeat(","+row, count-1)
 }
 
 // Helper functions
 
+// serverDSN removes the database name from the DSN so it can be used to connect to the server
+// when the database does not exist yet. All other parameters are preserved.
+func serverDSN(dsn string) (string, error) {
+	cfg, err := ms.ParseDSN(dsn)
+	if err != nil {
+		return "", errors.New("mysql adapter failed to parse DSN: " + err.Error())
+	}
+	cfg.DBName = ""
+	return cfg.FormatDSN(), nil
+}
+
+// Merge TLS settings from config into the DSN. If certificates are given, a custom TLS
+// config is registered with the driver and referenced from the DSN by name.
+func dsnWithTLS(dsn string, config *configType) (string, error) {
+	if config.TLS == "" && config.TLSRootCert == "" && config.TLSCert == "" {
+		return dsn, nil
+	}
+
+	cfg, err := ms.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+
+	if config.TLSRootCert == "" && config.TLSCert == "" {
+		cfg.TLSConfig = config.TLS
+		return cfg.FormatDSN(), nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.TLS == "skip-verify"}
+	if config.TLSRootCert != "" {
+		pem, err := ioutil.ReadFile(config.TLSRootCert)
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return "", errors.New("failed to parse " + config.TLSRootCert)
+		}
+	}
+	if config.TLSCert != "" {
+		cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return "", err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if err = ms.RegisterTLSConfig(tlsConfigName, tlsConfig); err != nil {
+		return "", err
+	}
+	cfg.TLSConfig = tlsConfigName
+
+	return cfg.FormatDSN(), nil
+}
+
 // Check if MySQL error is a Error Code: 1062. Duplicate entry ... for key ...
 func isDupe(err error) bool {
 	if err == nil {
@@ -2552,6 +5116,8 @@ func isDupe(err error) bool {
 	return ok && myerr.Number == 1062
 }
 
+// isMissingDb checks if the error is ER_BAD_DB_ERROR, i.e. the database does not exist.
+// The error code is checked, not the message, which depends on the server locale.
 func isMissingDb(err error) bool {
 	if err == nil {
 		return false
@@ -2561,14 +5127,50 @@ func isMissingDb(err error) bool {
 	return ok && myerr.Number == 1049
 }
 
+// isRetryable checks if the failed transaction was rolled back or never started and can be safely repeated.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if err == driver.ErrBadConn {
+		// Returned by database/sql only if nothing was sent to the server.
+		return true
+	}
+
+	myerr, ok := err.(*ms.MySQLError)
+	if !ok {
+		return false
+	}
+	switch myerr.Number {
+	case 1040, // Too many connections
+		1205, // Lock wait timeout exceeded
+		1213: // Deadlock found when trying to get lock
+		return true
+	}
+	return false
+}
+
+func isMissingTable(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	myerr, ok := err.(*ms.MySQLError)
+	return ok && myerr.Number == 1146
+}
+
 // Convert to JSON before storing to JSON field.
-func toJSON(src interface{}) []byte {
+// Returns t.ErrMalformed if the value cannot be serialized, e.g. it contains a channel or a function.
+func toJSON(src interface{}) ([]byte, error) {
 	if src == nil {
-		return nil
+		return nil, nil
 	}
 
-	jval, _ := json.Marshal(src)
-	return jval
+	jval, err := json.Marshal(src)
+	if err != nil {
+		return nil, t.ErrMalformed
+	}
+	return jval, nil
 }
 
 // Deserialize JSON data from DB.
@@ -2584,6 +5186,62 @@ func fromJSON(src interface{}) interface{} {
 	return nil
 }
 
+// publicText extracts all strings from the public value for full-text indexing.
+func publicText(public interface{}) string {
+	var words []string
+	var collect func(val interface{})
+	collect = func(val interface{}) {
+		switch v := val.(type) {
+		case string:
+			if v != "" {
+				words = append(words, v)
+			}
+		case []interface{}:
+			for _, item := range v {
+				collect(item)
+			}
+		case map[string]interface{}:
+			// Sort keys so the text is stable.
+			keys := make([]string, 0, len(v))
+			for key := range v {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				collect(v[key])
+			}
+		case nil, float64, bool:
+			// Nothing to index.
+		default:
+			// Public may be a struct: convert it to generic JSON first.
+			if jval, err := toJSON(v); err == nil {
+				collect(fromJSON(jval))
+			}
+		}
+	}
+	collect(public)
+	return strings.Join(words, " ")
+}
+
+// fullTextTerms converts a free-text query into a MySQL boolean mode search where
+// every word must be present as a prefix.
+func fullTextTerms(query string) string {
+	var terms []string
+	for _, word := range strings.Fields(query) {
+		// Remove boolean mode operators.
+		word = strings.Map(func(r rune) rune {
+			if strings.ContainsRune(`+-<>()~*"@`, r) {
+				return -1
+			}
+			return r
+		}, word)
+		if word != "" {
+			terms = append(terms, "+"+word+"*")
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
 // UIDs are stored as decoded int64 values. Take decoded string representation of int64, produce UID.
 func encodeUidString(str string) t.Uid {
 	unum, _ := strconv.ParseInt(str, 10, 64)
@@ -2595,12 +5253,30 @@ func decodeUidString(str string) int64 {
 	return store.DecodeUid(uid)
 }
 
-// Convert update to a list of columns and arguments.
-func updateByMap(update map[string]interface{}) (cols []string, args []interface{}) {
+// updatableColumns lists columns which may be changed by updateByMap, by table.
+// Column names are concatenated into the query, thus unknown names must be rejected.
+var updatableColumns = map[string]map[string]bool{
+	"users": {"createdat": true, "updatedat": true, "deletedat": true, "state": true, "access": true,
+		"lastseen": true, "useragent": true, "public": true, "tags": true},
+	"topics": {"createdat": true, "updatedat": true, "deletedat": true, "touchedat": true, "usebt": true,
+		"owner": true, "access": true, "seqid": true, "delid": true, "public": true, "tags": true},
+	"subscriptions": {"createdat": true, "updatedat": true, "deletedat": true, "delid": true, "recvseqid": true,
+		"readseqid": true, "modewant": true, "modegiven": true, "private": true},
+}
+
+// Convert update to a list of columns and arguments. Returns t.ErrMalformed if the update
+// contains a column which does not exist in the table or cannot be updated.
+func updateByMap(table string, update map[string]interface{}) (cols []string, args []interface{}, err error) {
+	allowed := updatableColumns[table]
 	for col, arg := range update {
 		col = strings.ToLower(col)
+		if !allowed[col] {
+			return nil, nil, t.ErrMalformed
+		}
 		if col == "public" || col == "private" {
-			arg = toJSON(arg)
+			if arg, err = toJSON(arg); err != nil {
+				return nil, nil, err
+			}
 		}
 		cols = append(cols, col+"=?")
 		args = append(args, arg)
@@ -2608,6 +5284,111 @@ func updateByMap(update map[string]interface{}) (cols []string, args []interface
 	return
 }
 
+// topicCatFilter builds a condition matching names of p2p and group topics of the given categories.
+// All p2p and group topics are matched if cats is empty. 'me' and 'fnd' topics are never matched.
+func topicCatFilter(cats []t.TopicCat) (string, []interface{}) {
+	if len(cats) == 0 {
+		cats = []t.TopicCat{t.TopicCatP2P, t.TopicCatGrp}
+	}
+	var conds []string
+	var args []interface{}
+	for _, cat := range cats {
+		switch cat {
+		case t.TopicCatP2P:
+			conds = append(conds, "topic LIKE ?")
+			args = append(args, "p2p%")
+		case t.TopicCatGrp:
+			conds = append(conds, "topic LIKE ?")
+			args = append(args, "grp%")
+		}
+	}
+	if len(conds) == 0 {
+		return "FALSE", nil
+	}
+	return "(" + strings.Join(conds, " OR ") + ")", args
+}
+
+// Maximum length of the text of the message preview, in runes.
+const previewLength = 80
+
+// messagePreview builds a compact preview of the message to be shown in the contact list:
+// seq ID, sender, time and the beginning of the text of the content.
+func messagePreview(msg *t.Message) map[string]interface{} {
+	var text string
+	switch content := msg.Content.(type) {
+	case string:
+		text = content
+	case map[string]interface{}:
+		// Formatted text.
+		text, _ = content["txt"].(string)
+	}
+	if runes := []rune(text); len(runes) > previewLength {
+		text = string(runes[:previewLength])
+	}
+
+	return map[string]interface{}{
+		"seq":  msg.SeqId,
+		"from": msg.From,
+		"ts":   msg.CreatedAt,
+		"txt":  text,
+	}
+}
+
+// seqIdOrder returns the sort order of messages requested by opts.
+func seqIdOrder(opts *t.QueryOpt) string {
+	if opts != nil && opts.Ascending {
+		return "ASC"
+	}
+	return "DESC"
+}
+
+// resultLimit returns the maximum number of rows to return: opts.Limit capped by maxResults.
+// Negative opts.Limit removes the cap, in which case 0 is returned.
+func (a *adapter) resultLimit(opts *t.QueryOpt) int {
+	limit := a.maxResults
+	if opts != nil {
+		if opts.Limit < 0 {
+			return 0
+		}
+		if opts.Limit > 0 && opts.Limit < limit {
+			limit = opts.Limit
+		}
+	}
+	return limit
+}
+
+// modeFilter builds a condition which matches subscriptions where both modewant and modegiven
+// contain every permission of the given mode. Returns an empty condition if there is nothing to filter by.
+func modeFilter(mode t.AccessMode) (string, []interface{}) {
+	if mode == t.ModeNone || !mode.IsDefined() {
+		return "", nil
+	}
+
+	var conds []string
+	var args []interface{}
+	for _, flag := range mode.String() {
+		conds = append(conds, "INSTR(modewant,?)>0 AND INSTR(modegiven,?)>0")
+		args = append(args, string(flag), string(flag))
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// chunkArgs splits a list of query arguments into batches of at most size elements.
+func chunkArgs(args []interface{}, size int) [][]interface{} {
+	if size <= 0 {
+		size = defaultInBatchSize
+	}
+	var batches [][]interface{}
+	for len(args) > size {
+		batches = append(batches, args[:size])
+		args = args[size:]
+	}
+	if len(args) > 0 {
+		batches = append(batches, args)
+	}
+	return batches
+}
+
 // If Tags field is updated, get the tags so tags table cab be updated too.
 func extractTags(update map[string]interface{}) []string {
 	var tags []string
@@ -0,0 +1,2936 @@
+// +build mysql
+
+package mysql
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	ms "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/tinode/chat/server/auth"
+	"github.com/tinode/chat/server/store"
+	"github.com/tinode/chat/server/store/types"
+)
+
+// testDSNEnv is the environment variable with the DSN of the database used by the tests which need
+// a MySQL server. Such tests are skipped if it's not set. The database is dropped and recreated by
+// every test: never point it at a database with data.
+const testDSNEnv = "TINODE_MYSQL_TEST_DSN"
+
+// openTestDb creates an empty test database and opens the adapter connected to it.
+// Extra settings are added to the adapter config.
+func openTestDb(tb testing.TB, extra map[string]interface{}) *adapter {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		tb.Skip(testDSNEnv + " is not set")
+	}
+
+	config := map[string]interface{}{"dsn": dsn}
+	for key, val := range extra {
+		config[key] = val
+	}
+	adpConf, err := json.Marshal(config)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// Creating the database through the store also initializes the UID generator.
+	storeConf, _ := json.Marshal(map[string]interface{}{
+		"uid_key":  "la6YsO+bNX/+XIkOqc5Svw==",
+		"adapters": map[string]json.RawMessage{adapterName: adpConf},
+	})
+	if err = store.InitDb(string(storeConf), true); err != nil {
+		tb.Fatal(err)
+	}
+	// CreateDb leaves the adapter connected to the server without selecting the database.
+	store.Close()
+
+	a := &adapter{}
+	if err = a.Open(string(adpConf)); err != nil {
+		tb.Fatal(err)
+	}
+	return a
+}
+
+func newTestUser(tb testing.TB, a *adapter) types.Uid {
+	return newTestUserWithPublic(tb, a, nil)
+}
+
+func newTestUserWithPublic(tb testing.TB, a *adapter, public interface{}) types.Uid {
+	user := &types.User{Public: public}
+	user.SetUid(store.GetUid())
+	user.InitTimes()
+	if err := a.UserCreate(user); err != nil {
+		tb.Fatal(err)
+	}
+	return user.Uid()
+}
+
+// newTestTopic creates a group topic with the owner subscribed to it.
+func newTestTopic(tb testing.TB, a *adapter, owner types.Uid) string {
+	topic := &types.Topic{ObjHeader: types.ObjHeader{Id: "grp" + store.GetUidString()}, Owner: owner.String()}
+	topic.InitTimes()
+	if err := a.TopicCreate(topic); err != nil {
+		tb.Fatal(err)
+	}
+	subscribeTestUser(tb, a, topic.Id, owner, types.ModeCFull)
+	return topic.Id
+}
+
+func subscribeTestUser(tb testing.TB, a *adapter, topic string, user types.Uid, mode types.AccessMode) {
+	sub := &types.Subscription{User: user.String(), Topic: topic, ModeWant: mode, ModeGiven: mode}
+	sub.InitTimes()
+	if _, err := a.TopicShare([]*types.Subscription{sub}); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// saveTestMessages saves count messages from the user to the topic with SeqIDs starting at 1.
+func saveTestMessages(tb testing.TB, a *adapter, topic string, from types.Uid, count int) []*types.Message {
+	msgs := make([]*types.Message, count)
+	for i := range msgs {
+		msgs[i] = &types.Message{SeqId: i + 1, Topic: topic, From: from.String(), Content: fmt.Sprintf("message %d", i+1)}
+		msgs[i].InitTimes()
+	}
+	if err := a.MessageSaveAll(msgs); err != nil {
+		tb.Fatal(err)
+	}
+	return msgs
+}
+
+// newTestCred saves a credential of the user. Returns true if a new record was inserted.
+func newTestCred(tb testing.TB, a *adapter, uid types.Uid, method, value string, done bool) bool {
+	cred := &types.Credential{User: uid.String(), Method: method, Value: value, Resp: "123456", Done: done}
+	cred.InitTimes()
+	inserted, err := a.CredUpsert(cred)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return inserted
+}
+
+// seedDbVersion rolls the schema back by executing the statements and sets the database version.
+func seedDbVersion(tb testing.TB, a *adapter, version int, stmts ...string) {
+	for _, stmt := range stmts {
+		if _, err := a.db.Exec(stmt); err != nil {
+			tb.Fatal(stmt, err)
+		}
+	}
+	if _, err := a.db.Exec("UPDATE kvmeta SET `value`=? WHERE `key`='version'", version); err != nil {
+		tb.Fatal(err)
+	}
+	// Force the version to be read again.
+	a.version = 0
+}
+
+// schemaCount runs a COUNT(*) query against information_schema of the current database.
+func schemaCount(tb testing.TB, a *adapter, table, where string, args ...interface{}) int {
+	var count int
+	if err := a.db.Get(&count, "SELECT COUNT(*) FROM information_schema."+table+
+		" WHERE table_schema=DATABASE() AND "+where, args...); err != nil {
+		tb.Fatal(err)
+	}
+	return count
+}
+
+func TestMessageDeleteListMissingRange(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	saveTestMessages(t, a, topic, owner, 3)
+
+	// There are no messages to hard-delete.
+	err := a.MessageDeleteList(topic, &types.DelMessage{DelId: 1, SeqIdRanges: []types.Range{{Low: 10, Hi: 20}}})
+	if err != types.ErrMalformed {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+	var count int
+	if err = a.db.Get(&count, "SELECT COUNT(*) FROM dellog WHERE topic=?", topic); err != nil || count != 0 {
+		t.Errorf("dellog must be empty, got %d entries, %v", count, err)
+	}
+
+	// Soft-deleting for one user does not require existing messages.
+	err = a.MessageDeleteList(topic, &types.DelMessage{DelId: 1, DeletedFor: owner.String(),
+		SeqIdRanges: []types.Range{{Low: 10, Hi: 20}}})
+	if err != nil {
+		t.Errorf("soft delete failed: %v", err)
+	}
+
+	// Hard-deleting existing messages succeeds.
+	err = a.MessageDeleteList(topic, &types.DelMessage{DelId: 2, SeqIdRanges: []types.Range{{Low: 1, Hi: 3}}})
+	if err != nil {
+		t.Errorf("hard delete failed: %v", err)
+	}
+}
+
+func TestIsDupe(t *testing.T) {
+	cases := []struct {
+		err  error
+		dupe bool
+	}{
+		{nil, false},
+		{errors.New("duplicate entry"), false},
+		{&ms.MySQLError{Number: 1049, Message: "Unknown database 'tinode'"}, false},
+		{&ms.MySQLError{Number: 1062, Message: "Duplicate entry 'basic:alice' for key 'auth_uname'"}, true},
+		{&ms.MySQLError{Number: 1062, Message: "Duplicate entry 'email:alice@example.com' for key 'credentials_uniqueness'"}, true},
+	}
+
+	for i, tc := range cases {
+		if got := isDupe(tc.err); got != tc.dupe {
+			t.Errorf("case %d: isDupe(%v) = %v, expected %v", i, tc.err, got, tc.dupe)
+		}
+	}
+}
+
+func TestIsMissingDb(t *testing.T) {
+	cases := []struct {
+		err     error
+		missing bool
+	}{
+		{nil, false},
+		{errors.New("Unknown database 'tinode'"), false},
+		{&ms.MySQLError{Number: 1049, Message: "Base de données 'tinode' inconnue"}, true},
+		{&ms.MySQLError{Number: 1146, Message: "Table 'tinode.kvmeta' doesn't exist"}, false},
+	}
+
+	for i, tc := range cases {
+		if got := isMissingDb(tc.err); got != tc.missing {
+			t.Errorf("case %d: isMissingDb(%v) = %v, expected %v", i, tc.err, got, tc.missing)
+		}
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	if jval, err := toJSON(nil); jval != nil || err != nil {
+		t.Errorf("nil must be stored as NULL, got %q, %v", jval, err)
+	}
+	if jval, err := toJSON(map[string]interface{}{"fn": "Alice"}); err != nil || string(jval) != `{"fn":"Alice"}` {
+		t.Errorf("unexpected result %q, %v", jval, err)
+	}
+	if _, err := toJSON(map[string]interface{}{"ch": make(chan int)}); err != types.ErrMalformed {
+		t.Errorf("expected ErrMalformed for a channel, got %v", err)
+	}
+
+	if _, _, err := updateByMap("users", map[string]interface{}{"Public": func() {}}); err != types.ErrMalformed {
+		t.Errorf("expected ErrMalformed for a function, got %v", err)
+	}
+	cols, args, err := updateByMap("subscriptions", map[string]interface{}{"Private": "note"})
+	if err != nil || len(cols) != 1 || cols[0] != "private=?" || string(args[0].([]byte)) != `"note"` {
+		t.Errorf("unexpected result %v, %v, %v", cols, args, err)
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	// sqlx.Open does not connect, so no live database is needed: a cancelled context
+	// must be reported before any attempt to reach the server.
+	db, err := sqlx.Open("mysql", defaultDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &adapter{db: db, maxResults: defaultMaxResults}
+	defer a.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := a.UserGetCtx(ctx, types.ZeroUid); err != context.Canceled {
+		t.Errorf("UserGetCtx: expected context.Canceled, got %v", err)
+	}
+	if _, err := a.TopicGetCtx(ctx, "grpAbCdEfGhIjK"); err != context.Canceled {
+		t.Errorf("TopicGetCtx: expected context.Canceled, got %v", err)
+	}
+	if _, err := a.MessageGetAllCtx(ctx, "grpAbCdEfGhIjK", types.ZeroUid, nil); err != context.Canceled {
+		t.Errorf("MessageGetAllCtx: expected context.Canceled, got %v", err)
+	}
+}
+
+func TestOpenPoolConfig(t *testing.T) {
+	// Nothing listens on port 1: Ping fails but the pool is configured by then.
+	a := &adapter{}
+	a.Open(`{"dsn": "root@tcp(127.0.0.1:1)/tinode?parseTime=true", "max_open_conns": 7}`)
+	if a.db == nil {
+		t.Fatal("Open did not initialize the connection pool")
+	}
+	defer a.Close()
+
+	if max := a.db.Stats().MaxOpenConnections; max != 7 {
+		t.Errorf("MaxOpenConnections = %d, expected 7", max)
+	}
+}
+
+func TestOpenConnectTimeout(t *testing.T) {
+	// Non-routable address: connection attempt hangs until the timeout.
+	a := &adapter{}
+	start := time.Now()
+	err := a.Open(`{"dsn": "root@tcp(10.255.255.1:3306)/tinode?parseTime=true", "connect_timeout": 1}`)
+	defer a.Close()
+
+	if err == nil {
+		t.Fatal("expected a connection error")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Open returned after %v, expected about 1s", elapsed)
+	}
+}
+
+func TestDSNWithTLS(t *testing.T) {
+	// DSN without query parameters.
+	dsn, err := dsnWithTLS("root@tcp(localhost)/tinode", &configType{TLS: "skip-verify"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "tls=skip-verify") {
+		t.Errorf("TLS mode not added to DSN: %s", dsn)
+	}
+
+	// TLS in config overrides TLS in DSN.
+	dsn, err = dsnWithTLS("root@tcp(localhost)/tinode?parseTime=true&tls=false", &configType{TLS: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "tls=true") || !strings.Contains(dsn, "parseTime=true") {
+		t.Errorf("TLS mode not merged into DSN: %s", dsn)
+	}
+
+	// Unchanged when TLS is not configured.
+	if dsn, _ = dsnWithTLS("garbage", &configType{}); dsn != "garbage" {
+		t.Errorf("DSN unexpectedly changed: %s", dsn)
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	dsn, err := prepareDSN("root@tcp(localhost)/tinode?parseTime=true", "tinode", &configType{StatementTimeout: 1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(dsn, "max_execution_time=1500") {
+		t.Errorf("statement timeout not set in DSN: %s", dsn)
+	}
+
+	if dsn, _ = prepareDSN("root@tcp(localhost)/tinode", "tinode", &configType{}); strings.Contains(dsn, "max_execution_time") {
+		t.Errorf("statement timeout unexpectedly set: %s", dsn)
+	}
+}
+
+func TestServerDSN(t *testing.T) {
+	for _, dsn := range []string{
+		"root@tcp(localhost)/tinode",
+		"root@tcp(localhost:3306)/tinode?parseTime=true&collation=utf8mb4_unicode_ci",
+		"root:secret@unix(/var/run/mysqld/mysqld.sock)/tinode?parseTime=true",
+		"root@tcp(localhost)/",
+	} {
+		sdsn, err := serverDSN(dsn)
+		if err != nil {
+			t.Errorf("%s: %v", dsn, err)
+			continue
+		}
+		if strings.Contains(sdsn, "tinode") {
+			t.Errorf("%s: database name not removed: %s", dsn, sdsn)
+		}
+		if strings.Contains(dsn, "parseTime=true") && !strings.Contains(sdsn, "parseTime=true") {
+			t.Errorf("%s: parameters lost: %s", dsn, sdsn)
+		}
+	}
+
+	if _, err := serverDSN("host=localhost dbname=tinode"); err == nil {
+		t.Error("expected an error for a key=value DSN")
+	}
+}
+
+func TestUpgradeSteps(t *testing.T) {
+	if len(dbUpgrades) == 0 {
+		t.Fatal("no upgrade steps")
+	}
+	for i := 1; i < len(dbUpgrades); i++ {
+		if dbUpgrades[i].from != dbUpgrades[i-1].from+1 {
+			t.Errorf("upgrade steps are not contiguous: %d follows %d", dbUpgrades[i].from, dbUpgrades[i-1].from)
+		}
+	}
+	if last := dbUpgrades[len(dbUpgrades)-1].from + 1; last != adpVersion {
+		t.Errorf("upgrade steps end at version %d, expected %d", last, adpVersion)
+	}
+}
+
+func TestUpgradeDbFrom107(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	if err := a.TopicUpdate(topic, map[string]interface{}{"Public": map[string]interface{}{"fn": "Upgraded"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Roll the schema back to what it was at version 107.
+	seedDbVersion(t, a, 107,
+		"ALTER TABLE topics DROP COLUMN pubtext",
+		"ALTER TABLE topics DROP COLUMN lastmsg",
+		"ALTER TABLE auth DROP COLUMN updatedat",
+		"DROP INDEX subscriptions_updatedat ON subscriptions",
+		"DROP TABLE msgreactions",
+		"DROP TABLE msgoutbox",
+		"DROP TABLE msgedits")
+	if _, err := a.db.Exec("UPDATE users SET access=JSON_OBJECT('Auth','JRWPA','Anon','N') WHERE id=?",
+		store.DecodeUid(uid)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.UpgradeDb(); err != nil {
+		t.Fatal(err)
+	}
+	if vers, err := a.GetDbVersion(); err != nil || vers != adpVersion {
+		t.Fatalf("expected version %d, got %d, %v", adpVersion, vers, err)
+	}
+
+	for _, col := range [][2]string{{"topics", "pubtext"}, {"topics", "lastmsg"}, {"auth", "updatedat"}} {
+		if schemaCount(t, a, "columns", "table_name=? AND column_name=?", col[0], col[1]) != 1 {
+			t.Errorf("column %s.%s is missing", col[0], col[1])
+		}
+	}
+	for _, table := range []string{"msgreactions", "msgoutbox", "msgedits"} {
+		if schemaCount(t, a, "tables", "table_name=?", table) != 1 {
+			t.Errorf("table %s is missing", table)
+		}
+	}
+	for _, idx := range [][2]string{{"topics", "topics_pubtext"}, {"subscriptions", "subscriptions_updatedat"}} {
+		if schemaCount(t, a, "statistics", "table_name=? AND index_name=?", idx[0], idx[1]) == 0 {
+			t.Errorf("index %s on %s is missing", idx[1], idx[0])
+		}
+	}
+
+	var access string
+	if err := a.db.Get(&access, "SELECT JSON_UNQUOTE(JSON_EXTRACT(access,'$.Auth')) FROM users WHERE id=?",
+		store.DecodeUid(uid)); err != nil || access != "JRWPAS" {
+		t.Errorf("default access is not upgraded: %q, %v", access, err)
+	}
+	var pubtext sql.NullString
+	if err := a.db.Get(&pubtext, "SELECT pubtext FROM topics WHERE name=?", topic); err != nil ||
+		!strings.Contains(pubtext.String, "Upgraded") {
+		t.Errorf("pubtext is not populated: %v, %v", pubtext, err)
+	}
+}
+
+func TestUpgradeDbHalfApplied(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	// The column was added by a failed upgrade from 108 but the index was not created and the version was not bumped.
+	seedDbVersion(t, a, 108, "DROP INDEX topics_pubtext ON topics")
+
+	if err := a.UpgradeDb(); err != nil {
+		t.Fatal(err)
+	}
+	if vers, err := a.GetDbVersion(); err != nil || vers != adpVersion {
+		t.Errorf("expected version %d, got %d, %v", adpVersion, vers, err)
+	}
+	if schemaCount(t, a, "statistics", "table_name='topics' AND index_name='topics_pubtext'") == 0 {
+		t.Error("index topics_pubtext is missing")
+	}
+}
+
+func TestQueryHook(t *testing.T) {
+	// Nothing listens on port 1: the query fails but the hook must still be called.
+	db, err := sqlx.Open("mysql", "root@tcp(127.0.0.1:1)/tinode?parseTime=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &adapter{db: db, maxResults: defaultMaxResults}
+	defer a.Close()
+
+	var calls []string
+	a.SetQueryHook(func(method string, dur time.Duration, err error) {
+		if err == nil {
+			t.Errorf("%s: expected an error", method)
+		}
+		calls = append(calls, method)
+	})
+
+	a.TopicsForUser(types.ZeroUid, false, nil)
+	a.UsersForTopic("grpAbCdEfGhIjK", false, nil)
+	if len(calls) != 2 || calls[0] != "TopicsForUser" || calls[1] != "UsersForTopic" {
+		t.Errorf("unexpected hook calls: %v", calls)
+	}
+}
+
+func TestChunkArgs(t *testing.T) {
+	var args []interface{}
+	for i := 0; i < 10; i++ {
+		args = append(args, i)
+	}
+
+	cases := []struct {
+		size  int
+		count int
+		last  int
+	}{
+		{3, 4, 1},
+		{5, 2, 5},
+		{10, 1, 10},
+		{100, 1, 10},
+	}
+	for _, tc := range cases {
+		batches := chunkArgs(args, tc.size)
+		if len(batches) != tc.count || len(batches[len(batches)-1]) != tc.last {
+			t.Errorf("size %d: got %d batches, expected %d with %d in the last one", tc.size, len(batches), tc.count, tc.last)
+			continue
+		}
+		// All arguments are present exactly once and in order.
+		i := 0
+		for _, batch := range batches {
+			for _, arg := range batch {
+				if arg.(int) != i {
+					t.Errorf("size %d: argument %v at position %d", tc.size, arg, i)
+				}
+				i++
+			}
+		}
+	}
+
+	if batches := chunkArgs(nil, 3); len(batches) != 0 {
+		t.Errorf("expected no batches for empty list, got %d", len(batches))
+	}
+}
+
+func TestHealthy(t *testing.T) {
+	a := &adapter{}
+	if a.Healthy(context.Background()) == nil {
+		t.Error("Healthy must fail when not connected")
+	}
+
+	// Nothing listens on port 1.
+	db, err := sqlx.Open("mysql", "root@tcp(127.0.0.1:1)/tinode?parseTime=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.db = db
+	defer a.Close()
+
+	if !a.IsOpen() {
+		t.Error("IsOpen must be true once the pool is initialized")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if a.Healthy(ctx) == nil {
+		t.Error("Healthy must fail when the server is unreachable")
+	}
+}
+
+func TestOpenDatabaseName(t *testing.T) {
+	cases := []struct {
+		config string
+		dbName string
+	}{
+		{`{"dsn": "root@tcp(127.0.0.1:1)/tinode?parseTime=true", "database": "tenant2"}`, "tenant2"},
+		{`{"dsn": "root@tcp(127.0.0.1:1)/tenant3?parseTime=true"}`, "tenant3"},
+		{`{"dsn": "root@tcp(127.0.0.1:1)/?parseTime=true"}`, defaultDatabase},
+	}
+
+	for _, tc := range cases {
+		a := &adapter{}
+		// Nothing listens on port 1, the error is expected.
+		a.Open(tc.config)
+		a.Close()
+
+		if a.dbName != tc.dbName {
+			t.Errorf("%s: database %q, expected %q", tc.config, a.dbName, tc.dbName)
+		}
+		cfg, err := ms.ParseDSN(a.dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.DBName != tc.dbName {
+			t.Errorf("%s: DSN database %q, expected %q", tc.config, cfg.DBName, tc.dbName)
+		}
+	}
+}
+
+func TestReader(t *testing.T) {
+	primary, err := sqlx.Open("mysql", defaultDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replica, err := sqlx.Open("mysql", defaultDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &adapter{db: primary}
+	defer a.Close()
+
+	if a.reader(context.Background()) != primary {
+		t.Error("reads must go to primary when no replica is configured")
+	}
+
+	a.rdb = replica
+	if a.reader(context.Background()) != replica {
+		t.Error("reads must go to the replica")
+	}
+	if a.reader(WithPrimary(context.Background())) != primary {
+		t.Error("WithPrimary must send reads to primary")
+	}
+}
+
+func TestGroupDelLog(t *testing.T) {
+	entries := []dellogEntry{
+		{Topic: "grpAbCdEfGhIjK", Delid: 1, Low: 5, Hi: 6},
+		{Topic: "grpAbCdEfGhIjK", Delid: 2, Low: 10, Hi: 20},
+		{Topic: "grpAbCdEfGhIjK", Delid: 2, Low: 25, Hi: 26},
+		{Topic: "grpAbCdEfGhIjK", Delid: 3, Low: 30, Hi: 32},
+	}
+	expected := []types.DelMessage{
+		{Topic: "grpAbCdEfGhIjK", DelId: 1, SeqIdRanges: []types.Range{{Low: 5}}},
+		{Topic: "grpAbCdEfGhIjK", DelId: 2, SeqIdRanges: []types.Range{{Low: 10, Hi: 20}, {Low: 25}}},
+		{Topic: "grpAbCdEfGhIjK", DelId: 3, SeqIdRanges: []types.Range{{Low: 30, Hi: 32}}},
+	}
+
+	if got := groupDelLog(entries); !reflect.DeepEqual(got, expected) {
+		t.Errorf("groupDelLog:\n got %+v\n expected %+v", got, expected)
+	}
+	if got := groupDelLog(nil); got != nil {
+		t.Errorf("expected nil for no entries, got %+v", got)
+	}
+}
+
+func TestPublicText(t *testing.T) {
+	cases := []struct {
+		public interface{}
+		text   string
+	}{
+		{nil, ""},
+		{"Book club", "Book club"},
+		{map[string]interface{}{"fn": "Book club", "note": "Monthly reading", "n": 5.0}, "Book club Monthly reading"},
+		{struct {
+			Fn   string `json:"fn"`
+			Tags []string
+		}{"Chess", []string{"openings", "endgames"}}, "openings endgames Chess"},
+	}
+	for i, tc := range cases {
+		if text := publicText(tc.public); text != tc.text {
+			t.Errorf("case %d: got %q, expected %q", i, text, tc.text)
+		}
+	}
+}
+
+func TestFullTextTerms(t *testing.T) {
+	cases := map[string]string{
+		"":                "",
+		"  ":              "",
+		"book":            "+book*",
+		"book  cl":        "+book* +cl*",
+		`+-book* "club"~`: "+book* +club*",
+		"(*)":             "",
+	}
+	for query, terms := range cases {
+		if got := fullTextTerms(query); got != terms {
+			t.Errorf("%q: got %q, expected %q", query, got, terms)
+		}
+	}
+}
+
+func TestAddTagsQuery(t *testing.T) {
+	query := addTagsQuery("usertags", "userid", 3, false)
+	if query != "INSERT INTO usertags(userid,tag) VALUES(?,?),(?,?),(?,?)" {
+		t.Errorf("unexpected query: %s", query)
+	}
+	if strings.Count(query, "?") != 6 {
+		t.Errorf("expected 6 placeholders: %s", query)
+	}
+
+	query = addTagsQuery("topictags", "topic", 1, true)
+	if query != "INSERT INTO topictags(topic,tag) VALUES(?,?) ON DUPLICATE KEY UPDATE tag=tag" {
+		t.Errorf("unexpected query: %s", query)
+	}
+}
+
+func TestAuthRecordColumns(t *testing.T) {
+	// Columns selected by AuthGetRecord and AuthGetUniqueRecord.
+	columns := []string{"uname", "userid", "secret", "expires", "authlvl"}
+
+	fields := sqlx.NewDb(nil, "mysql").Mapper.TypeMap(reflect.TypeOf(authRecord{}))
+	for _, col := range columns {
+		if fields.GetByPath(col) == nil {
+			t.Errorf("column %q is not mapped to a field", col)
+		}
+	}
+	if fi := fields.GetByPath("authlvl"); fi != nil && fi.Field.Name != "Authlvl" {
+		t.Errorf("authlvl mapped to %s", fi.Field.Name)
+	}
+}
+
+func TestParseDbVersion(t *testing.T) {
+	cases := []struct {
+		value string
+		err   error
+		vers  int
+		res   error
+	}{
+		{"", &ms.MySQLError{Number: 1049, Message: "Unknown database 'tinode'"}, -1, ErrDbMissing},
+		{"", &ms.MySQLError{Number: 1146, Message: "Table 'tinode.kvmeta' doesn't exist"}, -1, ErrDbNotInitialized},
+		{"", sql.ErrNoRows, -1, ErrDbNotInitialized},
+		{"109", nil, 109, nil},
+		{" 109\n", nil, 109, nil},
+	}
+	for i, tc := range cases {
+		vers, err := parseDbVersion(tc.value, tc.err)
+		if vers != tc.vers || err != tc.res {
+			t.Errorf("case %d: got (%d, %v), expected (%d, %v)", i, vers, err, tc.vers, tc.res)
+		}
+	}
+
+	if _, err := parseDbVersion("abc", nil); err == nil {
+		t.Error("expected an error for a non-numeric version")
+	}
+}
+
+func TestModeFilter(t *testing.T) {
+	if cond, args := modeFilter(types.ModeNone); cond != "" || args != nil {
+		t.Errorf("ModeNone must not filter: %q %v", cond, args)
+	}
+	if cond, _ := modeFilter(types.ModeUnset); cond != "" {
+		t.Errorf("ModeUnset must not filter: %q", cond)
+	}
+
+	cond, args := modeFilter(types.ModeRead | types.ModePres)
+	if cond != "INSTR(modewant,?)>0 AND INSTR(modegiven,?)>0 AND INSTR(modewant,?)>0 AND INSTR(modegiven,?)>0" {
+		t.Errorf("unexpected condition: %s", cond)
+	}
+	if !reflect.DeepEqual(args, []interface{}{"R", "R", "P", "P"}) {
+		t.Errorf("unexpected arguments: %v", args)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	a := &adapter{maxRetries: 3, retryBackoff: time.Millisecond}
+
+	// Fails with a deadlock once then succeeds.
+	calls := 0
+	err := a.withRetry(func() error {
+		calls++
+		if calls == 1 {
+			return &ms.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+		}
+		return nil
+	})
+	if err != nil || calls != 2 {
+		t.Errorf("expected success on the second call, got %v after %d calls", err, calls)
+	}
+
+	// Non-retryable errors are returned immediately.
+	calls = 0
+	dupe := &ms.MySQLError{Number: 1062, Message: "Duplicate entry"}
+	if err = a.withRetry(func() error { calls++; return dupe }); err != dupe || calls != 1 {
+		t.Errorf("expected the duplicate error after 1 call, got %v after %d calls", err, calls)
+	}
+
+	// Gives up after maxRetries.
+	calls = 0
+	lockWait := &ms.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}
+	if err = a.withRetry(func() error { calls++; return lockWait }); err != lockWait || calls != 4 {
+		t.Errorf("expected the lock wait error after 4 calls, got %v after %d calls", err, calls)
+	}
+}
+
+func TestWithTxBeginFailure(t *testing.T) {
+	// Nothing listens on port 1: the transaction cannot start and fn must not be called.
+	db, err := sqlx.Open("mysql", "root@tcp(127.0.0.1:1)/tinode?parseTime=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &adapter{db: db}
+	defer a.Close()
+
+	called := false
+	if err = a.withTx(func(tx *sqlx.Tx) error { called = true; return nil }); err == nil {
+		t.Error("expected an error")
+	}
+	if called {
+		t.Error("fn must not be called when the transaction cannot be started")
+	}
+}
+
+func TestResultLimit(t *testing.T) {
+	a := &adapter{maxResults: 100}
+	cases := []struct {
+		opts  *types.QueryOpt
+		limit int
+	}{
+		{nil, 100},
+		{&types.QueryOpt{}, 100},
+		{&types.QueryOpt{Limit: 10}, 10},
+		{&types.QueryOpt{Limit: 1000}, 100},
+		{&types.QueryOpt{Limit: -1}, 0},
+	}
+	for i, tc := range cases {
+		if limit := a.resultLimit(tc.opts); limit != tc.limit {
+			t.Errorf("case %d: got %d, expected %d", i, limit, tc.limit)
+		}
+	}
+}
+
+func TestMessageQuery(t *testing.T) {
+	a := &adapter{maxResults: 100}
+	q, args := a.messageQuery("grpTopic", types.Uid(0), &types.QueryOpt{Since: 5, Before: 10, Limit: -1})
+	if strings.Contains(q, "LIMIT") {
+		t.Errorf("uncapped query must not have LIMIT: %s", q)
+	}
+	if len(args) != 4 || args[1] != 5 || args[2] != 9 {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	q, args = a.messageQuery("grpTopic", types.Uid(0), nil)
+	if !strings.HasSuffix(q, "ORDER BY m.seqid DESC LIMIT ?") {
+		t.Errorf("unexpected query: %s", q)
+	}
+	if len(args) != 5 || args[4] != 100 {
+		t.Errorf("unexpected args %v", args)
+	}
+}
+
+func TestMessageIdsQuery(t *testing.T) {
+	ids := uniqueSeqIds([]int{42, 3, 17, 3})
+	if !reflect.DeepEqual(ids, []interface{}{3, 17, 42}) {
+		t.Errorf("unexpected ids %v", ids)
+	}
+
+	q, args := messageIdsQuery("grpTopic", types.Uid(0), ids)
+	if !strings.Contains(q, "m.seqid IN (?, ?, ?)") || !strings.Contains(q, "FROM dellog") {
+		t.Errorf("unexpected query: %s", q)
+	}
+	if len(args) != 5 || args[0] != "grpTopic" || args[1] != 3 || args[3] != 42 {
+		t.Errorf("unexpected args %v", args)
+	}
+}
+
+func TestAuthExpires(t *testing.T) {
+	// Never expires.
+	if exp := expiresToDb(time.Time{}); exp != nil {
+		t.Errorf("zero expiration must be stored as NULL, got %v", exp)
+	}
+	if exp := (&authRecord{}).expiresTime(); !exp.IsZero() {
+		t.Errorf("NULL expiration must be read as zero time, got %v", exp)
+	}
+
+	// Past and future expiration times round-trip unchanged.
+	for _, when := range []time.Time{time.Now().Add(-time.Hour), time.Now().Add(time.Hour)} {
+		rec := authRecord{Expires: expiresToDb(when)}
+		if exp := rec.expiresTime(); !exp.Equal(when) {
+			t.Errorf("expected %v, got %v", when, exp)
+		}
+	}
+}
+
+func TestStripUnmodified(t *testing.T) {
+	ims := time.Now().Add(-time.Hour)
+	subs := make([]types.Subscription, 3)
+	for i, updated := range []time.Time{ims.Add(-time.Hour), ims, ims.Add(time.Minute)} {
+		subs[i].UpdatedAt = updated
+		subs[i].Private = "private"
+		subs[i].SetPublic("public")
+	}
+
+	stripUnmodified(subs, ims)
+	for i, stripped := range []bool{true, true, false} {
+		if (subs[i].Private == nil) != stripped || (subs[i].GetPublic() == nil) != stripped {
+			t.Errorf("subscription %d: private %v, public %v, expected stripped=%v",
+				i, subs[i].Private, subs[i].GetPublic(), stripped)
+		}
+	}
+}
+
+func TestBulkInsertQuery(t *testing.T) {
+	query := bulkInsertQuery("usertags", []string{"userid", "tag"}, 3)
+	if query != "INSERT INTO usertags(userid,tag) VALUES (?,?),(?,?),(?,?)" {
+		t.Errorf("unexpected query: %s", query)
+	}
+	query = bulkInsertQuery("users", []string{"id"}, 1)
+	if query != "INSERT INTO users(id) VALUES (?)" {
+		t.Errorf("unexpected query: %s", query)
+	}
+}
+
+func TestTagSearchQuery(t *testing.T) {
+	cases := []struct {
+		req, opt []string
+		query    string
+		args     []interface{}
+	}{
+		// Required only.
+		{[]string{"a", "b"}, nil,
+			"SELECT x FROM y WHERE t.tag IN (?, ?) AND z GROUP BY g HAVING SUM(t.tag IN (?, ?))>=? ORDER BY o LIMIT ?",
+			[]interface{}{"a", "b", "a", "b", 2, 10}},
+		// Optional only.
+		{nil, []string{"c"},
+			"SELECT x FROM y WHERE t.tag IN (?) AND z GROUP BY g ORDER BY o LIMIT ?",
+			[]interface{}{"c", 10}},
+		// Mixed.
+		{[]string{"a"}, []string{"c", "d"},
+			"SELECT x FROM y WHERE t.tag IN (?, ?, ?) AND z GROUP BY g HAVING SUM(t.tag IN (?))>=? ORDER BY o LIMIT ?",
+			[]interface{}{"a", "c", "d", "a", 1, 10}},
+	}
+	for i, tc := range cases {
+		query, args, err := tagSearchQuery("SELECT x FROM y", "t.tag", "z", "g", "o", tc.req, tc.opt, 10)
+		if err != nil {
+			t.Errorf("case %d: %v", i, err)
+			continue
+		}
+		if query != tc.query {
+			t.Errorf("case %d: query\n got %s\n expected %s", i, query, tc.query)
+		}
+		if !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("case %d: args %v, expected %v", i, args, tc.args)
+		}
+	}
+
+	if _, _, err := tagSearchQuery("SELECT x FROM y", "t.tag", "z", "g", "o", nil, nil, 10); err == nil {
+		t.Error("expected an error for an empty tag list")
+	}
+}
+
+func TestSeqIdOrder(t *testing.T) {
+	if order := seqIdOrder(nil); order != "DESC" {
+		t.Errorf("default order must be DESC, got %s", order)
+	}
+	if order := seqIdOrder(&types.QueryOpt{Ascending: true}); order != "ASC" {
+		t.Errorf("expected ASC, got %s", order)
+	}
+}
+
+func TestSeqRangesWhere(t *testing.T) {
+	where, args := seqRangesWhere("seqid", []types.Range{{Low: 5}, {Low: 10, Hi: 20}})
+	if where != "(seqid=? OR seqid BETWEEN ? AND ?)" {
+		t.Errorf("unexpected condition: %s", where)
+	}
+	if !reflect.DeepEqual(args, []interface{}{5, 10, 19}) {
+		t.Errorf("unexpected args: %v", args)
+	}
+}
+
+func TestTopicCatFilter(t *testing.T) {
+	cases := []struct {
+		cats  []types.TopicCat
+		where string
+		args  []interface{}
+	}{
+		{nil, "(topic LIKE ? OR topic LIKE ?)", []interface{}{"p2p%", "grp%"}},
+		{[]types.TopicCat{types.TopicCatGrp}, "(topic LIKE ?)", []interface{}{"grp%"}},
+		{[]types.TopicCat{types.TopicCatMe, types.TopicCatFnd}, "FALSE", nil},
+	}
+	for i, tc := range cases {
+		where, args := topicCatFilter(tc.cats)
+		if where != tc.where || !reflect.DeepEqual(args, tc.args) {
+			t.Errorf("case %d: got %q %v, expected %q %v", i, where, args, tc.where, tc.args)
+		}
+	}
+}
+
+func TestUpdateByMapColumns(t *testing.T) {
+	for _, key := range []string{"public=NULL, owner", "id", "pubtext", "Private"} {
+		if _, _, err := updateByMap("topics", map[string]interface{}{key: 1}); err != types.ErrMalformed {
+			t.Errorf("%q: expected ErrMalformed, got %v", key, err)
+		}
+	}
+
+	cols, _, err := updateByMap("topics", map[string]interface{}{"DelId": 5})
+	if err != nil || len(cols) != 1 || cols[0] != "delid=?" {
+		t.Errorf("unexpected result %v, %v", cols, err)
+	}
+	if _, _, err = updateByMap("unknown", map[string]interface{}{"DelId": 5}); err != types.ErrMalformed {
+		t.Errorf("unknown table: expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestMessagePreview(t *testing.T) {
+	long := strings.Repeat("я", previewLength+10)
+	cases := []struct {
+		content interface{}
+		text    string
+	}{
+		{"hello", "hello"},
+		{map[string]interface{}{"txt": "formatted", "fmt": []interface{}{}}, "formatted"},
+		{long, long[:previewLength*len("я")]},
+		{nil, ""},
+	}
+	for i, tc := range cases {
+		preview := messagePreview(&types.Message{SeqId: 7, From: "usrAbC", Content: tc.content})
+		if preview["txt"] != tc.text || preview["seq"] != 7 || preview["from"] != "usrAbC" {
+			t.Errorf("case %d: unexpected preview %v", i, preview)
+		}
+	}
+}
+
+func TestP2PSwapPublic(t *testing.T) {
+	alice, bob, stranger := types.Uid(1001), types.Uid(2002), types.Uid(3003)
+	topic := alice.P2PName(bob)
+
+	sub := func(uid types.Uid, public string) types.Subscription {
+		s := types.Subscription{User: uid.String(), Topic: topic}
+		s.SetPublic(public)
+		return s
+	}
+	// Bob's subscription is duplicated, the stray row belongs to neither user.
+	subs := []types.Subscription{sub(alice, "alice"), sub(bob, "bob"), sub(bob, "bob-dupe"), sub(stranger, "stranger")}
+
+	result := p2pSwapPublic(topic, subs, false, types.ZeroUid)
+	if len(result) != 2 {
+		t.Fatalf("expected 2 subscriptions, got %d", len(result))
+	}
+	for _, s := range result {
+		expected := "bob"
+		if s.User == bob.String() {
+			expected = "alice"
+		}
+		if s.GetPublic() != expected {
+			t.Errorf("%s: public %v, expected %s", s.User, s.GetPublic(), expected)
+		}
+	}
+
+	if result = p2pSwapPublic(topic, subs, false, bob); len(result) != 1 || result[0].GetPublic() != "alice" {
+		t.Errorf("unexpected result for one user: %v", result)
+	}
+
+	// The other user is deleted.
+	if result = p2pSwapPublic(topic, subs[:1], false, types.ZeroUid); len(result) != 1 || result[0].GetPublic() != nil {
+		t.Errorf("expected nil public, got %v", result)
+	}
+}
+
+func TestMergeDelRanges(t *testing.T) {
+	cases := []struct {
+		in, out []types.Range
+	}{
+		{nil, nil},
+		{[]types.Range{{Low: 1, Hi: 3}}, []types.Range{{Low: 1, Hi: 3}}},
+		// Adjacent, overlapping and nested ranges, out of order.
+		{[]types.Range{{Low: 5, Hi: 7}, {Low: 1, Hi: 3}, {Low: 3, Hi: 5}, {Low: 2, Hi: 4}, {Low: 10, Hi: 12}, {Low: 10, Hi: 11}},
+			[]types.Range{{Low: 1, Hi: 7}, {Low: 10, Hi: 12}}},
+		// Gap of one message.
+		{[]types.Range{{Low: 1, Hi: 3}, {Low: 4, Hi: 6}}, []types.Range{{Low: 1, Hi: 3}, {Low: 4, Hi: 6}}},
+	}
+	for i, tc := range cases {
+		if out := mergeDelRanges(tc.in); !reflect.DeepEqual(out, tc.out) {
+			t.Errorf("case %d: got %v, expected %v", i, out, tc.out)
+		}
+	}
+}
+
+func TestFileStartUploadZeroId(t *testing.T) {
+	a := &adapter{}
+	fd := &types.FileDef{User: types.Uid(1).String(), Status: types.UploadStarted}
+	if err := a.FileStartUpload(fd); err != types.ErrMalformed {
+		t.Errorf("expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestCheckFileLinksCancelled(t *testing.T) {
+	db, err := sqlx.Open("mysql", defaultDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &adapter{db: db}
+	defer a.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, clean := range []bool{false, true} {
+		if _, err := a.CheckFileLinks(ctx, clean); err != context.Canceled {
+			t.Errorf("clean=%t: expected context.Canceled, got %v", clean, err)
+		}
+	}
+}
+
+func TestMessageUpdateMalformed(t *testing.T) {
+	a := &adapter{}
+	if err := a.MessageUpdate("grpAbCdEfGhIjK", 0, nil, "edited"); err != types.ErrMalformed {
+		t.Errorf("zero seqid: expected ErrMalformed, got %v", err)
+	}
+	if err := a.MessageUpdate("grpAbCdEfGhIjK", 1, nil, func() {}); err != types.ErrMalformed {
+		t.Errorf("unserializable content: expected ErrMalformed, got %v", err)
+	}
+}
+
+// execOnlyConn is a driver connection which accepts any statement without a server.
+type execOnlyConn struct{}
+
+func (execOnlyConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (execOnlyConn) Close() error                        { return nil }
+func (execOnlyConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (execOnlyConn) ExecContext(context.Context, string, []driver.NamedValue) (driver.Result, error) {
+	return driver.RowsAffected(1), nil
+}
+
+type execOnlyDriver struct{}
+
+func (execOnlyDriver) Open(string) (driver.Conn, error) { return execOnlyConn{}, nil }
+
+func TestQueryLogRedactsSecrets(t *testing.T) {
+	var logged []string
+	connector := &loggingConnector{drv: execOnlyDriver{}, logf: func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}}
+	a := &adapter{db: sqlx.NewDb(sql.OpenDB(connector), "mysql")}
+	defer a.Close()
+
+	secret := []byte("s3cr3t")
+	if _, err := a.AuthAddRecord(types.ZeroUid, "basic", "basic:alice", auth.LevelAuth, secret, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(logged) != 1 || !strings.Contains(logged[0], "INSERT INTO auth") {
+		t.Fatalf("expected the statement to be logged, got %q", logged)
+	}
+	if strings.Contains(logged[0], string(secret)) || strings.Contains(logged[0], fmt.Sprint(secret)) ||
+		strings.Contains(logged[0], "basic:alice") {
+		t.Errorf("secret leaked to the log: %s", logged[0])
+	}
+
+	// Arguments of other columns are logged as is.
+	args := []driver.NamedValue{{Ordinal: 1, Value: "grpAbCdEfGhIjK"}}
+	if out := redactArgs("SELECT name FROM topics WHERE name=?", args); out[0] != "grpAbCdEfGhIjK" {
+		t.Errorf("unexpected redaction: %v", out)
+	}
+}
+
+func TestPlaceholderColumns(t *testing.T) {
+	cases := []struct {
+		query string
+		cols  []string
+	}{
+		{"UPDATE auth SET updatedat=IF(BINARY secret=BINARY ?,updatedat,?),uname=?,authLvl=?,secret=?,expires=? " +
+			"WHERE userid=? AND scheme=?",
+			[]string{"secret", "updatedat", "uname", "authlvl", "secret", "expires", "userid", "scheme"}},
+		{"INSERT INTO credentials(createdat,updatedat,method,value) VALUES(?,?,?,?),(?,?,?,?) " +
+			"ON DUPLICATE KEY UPDATE resp=?",
+			[]string{"createdat", "updatedat", "method", "value", "createdat", "updatedat", "method", "value", "resp"}},
+		// Secret columns are recognized in any table.
+		{"SELECT s.id FROM sessions AS s WHERE s.`secret`=? AND s.name IN (?, ?) LIMIT ?",
+			[]string{"secret", "name", "name", "limit"}},
+		// Placeholders in string literals are ignored.
+		{"SELECT id FROM topics WHERE JSON_EXTRACT(lastmsg,'$.txt?')=? AND name=?", []string{"lastmsg", "name"}},
+	}
+	for _, tc := range cases {
+		if cols := placeholderColumns(tc.query); !reflect.DeepEqual(cols, tc.cols) {
+			t.Errorf("%s: got %v, expected %v", tc.query, cols, tc.cols)
+		}
+	}
+
+	args := []driver.NamedValue{{Ordinal: 1, Value: []byte("s3cr3t")}, {Ordinal: 2, Value: int64(42)}}
+	if out := redactArgs("UPDATE sessions SET resp=? WHERE id=?", args); out[0] != "[redacted]" || out[1] != int64(42) {
+		t.Errorf("unexpected redaction: %v", out)
+	}
+}
+
+// countConn is a driver connection which returns a single count for any query.
+type countConn struct{ count int64 }
+
+func (countConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (countConn) Close() error                        { return nil }
+func (countConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c countConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	return &countRows{count: c.count}, nil
+}
+
+type countRows struct {
+	count int64
+	done  bool
+}
+
+func (r *countRows) Columns() []string { return []string{"count"} }
+func (r *countRows) Close() error      { return nil }
+func (r *countRows) Next(dest []driver.Value) error {
+	if r.done {
+		return io.EOF
+	}
+	r.done = true
+	dest[0] = r.count
+	return nil
+}
+
+// countDriver is both the driver and the connector of countConn.
+type countDriver struct{ count int64 }
+
+func (d countDriver) Open(string) (driver.Conn, error) { return countConn{count: d.count}, nil }
+func (d countDriver) Connect(context.Context) (driver.Conn, error) {
+	return countConn{count: d.count}, nil
+}
+func (d countDriver) Driver() driver.Driver { return d }
+
+func TestCheckCanCreate(t *testing.T) {
+	cases := []struct {
+		tables int64
+		reset  bool
+		ok     bool
+	}{
+		// Fresh database.
+		{0, false, true},
+		// Existing database is not dropped without reset.
+		{5, false, false},
+		// Forced reset.
+		{5, true, true},
+	}
+	for _, tc := range cases {
+		db := sql.OpenDB(countDriver{tc.tables})
+		err := checkCanCreate(db, "tinode", tc.reset)
+		if (err == nil) != tc.ok {
+			t.Errorf("tables=%d reset=%t: unexpected result %v", tc.tables, tc.reset, err)
+		}
+		db.Close()
+	}
+}
+
+func TestReadRecvUpdate(t *testing.T) {
+	now := time.Now()
+	if q, _ := readRecvUpdate(0, 0, now); q != "" {
+		t.Errorf("expected no update, got %s", q)
+	}
+
+	// Markers are only advanced: a lower read value sent out of order leaves the stored one intact.
+	q, args := readRecvUpdate(5, 0, now)
+	if q != "UPDATE subscriptions SET updatedat=IF(readseqid<? OR recvseqid<?,?,updatedat),"+
+		"readseqid=GREATEST(readseqid,?),recvseqid=GREATEST(recvseqid,?)" {
+		t.Errorf("unexpected query: %s", q)
+	}
+	if !reflect.DeepEqual(args, []interface{}{5, 5, now, 5, 5}) {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	q, args = readRecvUpdate(0, 7, now)
+	if strings.Contains(q, "readseqid") || !reflect.DeepEqual(args, []interface{}{7, now, 7}) {
+		t.Errorf("unexpected update: %s %v", q, args)
+	}
+}
+
+func TestNormalizeTags(t *testing.T) {
+	tags, err := normalizeTags([]string{"Email:Alice@Example.com", " travel ", "email:alice@example.com", "TRAVEL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tags, []string{"email:alice@example.com", "travel"}) {
+		t.Errorf("unexpected tags %v", tags)
+	}
+
+	// Length is counted in characters, not bytes.
+	if _, err = normalizeTags([]string{strings.Repeat("ж", maxTagLength)}); err != nil {
+		t.Errorf("tag of maximum length rejected: %v", err)
+	}
+	for _, tag := range []string{strings.Repeat("a", maxTagLength+1), "  "} {
+		if _, err = normalizeTags([]string{"travel", tag}); err != types.ErrMalformed {
+			t.Errorf("%q: expected ErrMalformed, got %v", tag, err)
+		}
+	}
+}
+
+func TestTopicsListQuery(t *testing.T) {
+	q, args := topicsListQuery(nil, false, 10)
+	if !strings.Contains(q, "deletedat IS NULL") || !strings.HasSuffix(q, "ORDER BY createdat,name LIMIT ?") {
+		t.Errorf("unexpected query: %s", q)
+	}
+	if !reflect.DeepEqual(args, []interface{}{10}) {
+		t.Errorf("unexpected args %v", args)
+	}
+
+	// The next page starts after the last topic of the previous one.
+	last := &types.Topic{ObjHeader: types.ObjHeader{Id: "grpAbCdEfGhIjK", CreatedAt: time.Now()}}
+	q, args = topicsListQuery(last, true, 10)
+	if strings.Contains(q, "deletedat IS NULL") || !strings.Contains(q, "(createdat>? OR (createdat=? AND name>?))") {
+		t.Errorf("unexpected query: %s", q)
+	}
+	if !reflect.DeepEqual(args, []interface{}{last.CreatedAt, last.CreatedAt, last.Id, 10}) {
+		t.Errorf("unexpected args %v", args)
+	}
+}
+
+// restoreFailConn is a driver connection which fails to re-enable the checks after an import.
+type restoreFailConn struct{ closed *bool }
+
+func (restoreFailConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (c restoreFailConn) Close() error                      { *c.closed = true; return nil }
+func (restoreFailConn) Begin() (driver.Tx, error)           { return noopTx{}, nil }
+func (restoreFailConn) ExecContext(_ context.Context, query string, _ []driver.NamedValue) (driver.Result, error) {
+	if strings.Contains(query, "checks=1") {
+		return nil, errors.New("connection lost")
+	}
+	return driver.RowsAffected(0), nil
+}
+
+type noopTx struct{}
+
+func (noopTx) Commit() error   { return nil }
+func (noopTx) Rollback() error { return nil }
+
+type restoreFailDriver struct{ closed *bool }
+
+func (d restoreFailDriver) Open(string) (driver.Conn, error) { return restoreFailConn{d.closed}, nil }
+func (d restoreFailDriver) Connect(context.Context) (driver.Conn, error) {
+	return restoreFailConn{d.closed}, nil
+}
+func (d restoreFailDriver) Driver() driver.Driver { return d }
+
+func TestImportTxDiscardsConnection(t *testing.T) {
+	closed := false
+	a := &adapter{db: sqlx.NewDb(sql.OpenDB(restoreFailDriver{&closed}), "mysql")}
+	defer a.Close()
+
+	if err := a.importTx(true, func(*sqlx.Tx) error { return nil }); err == nil {
+		t.Error("expected the restore error")
+	}
+	// The connection with the checks disabled must not be returned to the pool.
+	if !closed {
+		t.Error("connection was not discarded")
+	}
+}
+
+func TestUserStateFilter(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	active := newTestUser(t, a)
+	suspended := newTestUser(t, a)
+	if err := a.UserUpdateState(suspended, types.StateSuspended); err != nil {
+		t.Fatal(err)
+	}
+
+	if user, err := a.UserGet(suspended); err != nil || user != nil {
+		t.Errorf("UserGet: suspended user must not be returned, got %v, %v", user, err)
+	}
+	if user, err := a.UserGet(active); err != nil || user == nil {
+		t.Errorf("UserGet: active user not found: %v", err)
+	}
+	users, err := a.UserGetAll(active, suspended)
+	if err != nil || len(users) != 1 || users[0].Uid() != active {
+		t.Errorf("UserGetAll: expected only the active user, got %v, %v", users, err)
+	}
+
+	// Administrative fetches include suspended users.
+	if user, err := a.UserGetAnyState(suspended); err != nil || user == nil || user.State != types.StateSuspended {
+		t.Errorf("UserGetAnyState: expected the suspended user, got %v, %v", user, err)
+	}
+	if users, err = a.UserGetAllAnyState(active, suspended); err != nil || len(users) != 2 {
+		t.Errorf("UserGetAllAnyState: expected both users, got %v, %v", users, err)
+	}
+
+	// Reactivated user is visible again.
+	if err = a.UserUpdateState(suspended, types.StateOK); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.UserGet(suspended); err != nil || user == nil {
+		t.Errorf("UserGet: reactivated user not found: %v", err)
+	}
+}
+
+// recordingConn is a driver connection which counts queries and fails them.
+type recordingConn struct{ queries *int }
+
+func (recordingConn) Prepare(string) (driver.Stmt, error) { return nil, errors.New("not supported") }
+func (recordingConn) Close() error                        { return nil }
+func (recordingConn) Begin() (driver.Tx, error)           { return nil, errors.New("not supported") }
+func (c recordingConn) QueryContext(context.Context, string, []driver.NamedValue) (driver.Rows, error) {
+	*c.queries++
+	return nil, errors.New("recorded")
+}
+
+type recordingDriver struct{ queries *int }
+
+func (d recordingDriver) Open(string) (driver.Conn, error) { return recordingConn{d.queries}, nil }
+func (d recordingDriver) Connect(context.Context) (driver.Conn, error) {
+	return recordingConn{d.queries}, nil
+}
+func (d recordingDriver) Driver() driver.Driver { return d }
+
+func TestReadMethodsHonorPrimary(t *testing.T) {
+	var primary, replica int
+	a := &adapter{
+		db:          sqlx.NewDb(sql.OpenDB(recordingDriver{&primary}), "mysql"),
+		rdb:         sqlx.NewDb(sql.OpenDB(recordingDriver{&replica}), "mysql"),
+		maxResults:  defaultMaxResults,
+		inBatchSize: defaultInBatchSize,
+	}
+	defer a.Close()
+
+	reads := map[string]func(ctx context.Context){
+		"TopicsForUser": func(ctx context.Context) { a.TopicsForUserCtx(ctx, types.ZeroUid, false, nil) },
+		"UsersForTopic": func(ctx context.Context) { a.UsersForTopicCtx(ctx, "grpAbCdEfGhIjK", false, nil) },
+		"FindUsers":     func(ctx context.Context) { a.FindUsersCtx(ctx, types.ZeroUid, []string{"travel"}, nil) },
+		"SubsCountForTopic": func(ctx context.Context) {
+			a.SubsCountForTopicCtx(ctx, "grpAbCdEfGhIjK", false)
+		},
+	}
+	for name, read := range reads {
+		primary, replica = 0, 0
+		read(context.Background())
+		if primary != 0 || replica == 0 {
+			t.Errorf("%s: expected a read from the replica, primary=%d replica=%d", name, primary, replica)
+		}
+
+		primary, replica = 0, 0
+		read(WithPrimary(context.Background()))
+		if primary == 0 || replica != 0 {
+			t.Errorf("%s: expected a read from the primary, primary=%d replica=%d", name, primary, replica)
+		}
+	}
+}
+
+func TestUserDeleteMissing(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	missing := store.GetUid()
+	for _, hard := range []bool{false, true} {
+		if err := a.UserDelete(missing, hard); err != types.ErrNotFound {
+			t.Errorf("hard=%t: expected ErrNotFound, got %v", hard, err)
+		}
+	}
+
+	// Soft-deleting an already soft-deleted user is not an error.
+	uid := newTestUser(t, a)
+	if err := a.UserDelete(uid, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.UserDelete(uid, false); err != nil {
+		t.Errorf("repeated soft delete: %v", err)
+	}
+	// The soft-deleted user still exists and can be hard-deleted.
+	if err := a.UserDelete(uid, true); err != nil {
+		t.Errorf("hard delete of soft-deleted user: %v", err)
+	}
+	if err := a.UserDelete(uid, true); err != types.ErrNotFound {
+		t.Errorf("repeated hard delete: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestAuthUpdRecordRename(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	alice := newTestUser(t, a)
+	carol := newTestUser(t, a)
+	for uid, login := range map[types.Uid]string{alice: "basic:alice", carol: "basic:carol"} {
+		if _, err := a.AuthAddRecord(uid, "basic", login, auth.LevelAuth, []byte("secret"), time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := a.AuthUpdRecord(alice, "basic", "basic:bob", auth.LevelAuth, []byte("secret2"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	unique, lvl, secret, _, err := a.AuthGetRecord(alice, "basic")
+	if err != nil || unique != "basic:bob" || lvl != auth.LevelAuth || string(secret) != "secret2" {
+		t.Errorf("unexpected record %s %v %s, %v", unique, lvl, secret, err)
+	}
+	// The other user's record is not affected.
+	if unique, _, _, _, err = a.AuthGetRecord(carol, "basic"); err != nil || unique != "basic:carol" {
+		t.Errorf("unexpected record of the other user %s, %v", unique, err)
+	}
+
+	// Renaming to a login which is already taken.
+	dupe, err := a.AuthUpdRecord(alice, "basic", "basic:carol", auth.LevelAuth, []byte("secret2"), time.Time{})
+	if !dupe || err != types.ErrDuplicate {
+		t.Errorf("expected ErrDuplicate, got %t, %v", dupe, err)
+	}
+}
+
+func TestCredUpsertUndelete(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	if !newTestCred(t, a, uid, "email", "alice@example.com", false) {
+		t.Error("new credential must be inserted")
+	}
+	// Adding another unvalidated email soft-deletes the first one.
+	if !newTestCred(t, a, uid, "email", "bob@example.com", false) {
+		t.Error("new credential must be inserted")
+	}
+	if cred, err := a.CredGetActive(uid, "email"); err != nil || cred == nil || cred.Value != "bob@example.com" {
+		t.Fatalf("unexpected active credential %v, %v", cred, err)
+	}
+
+	// Re-adding the first email undeletes the existing record.
+	if newTestCred(t, a, uid, "email", "alice@example.com", false) {
+		t.Error("existing credential must be updated, not inserted")
+	}
+	if cred, err := a.CredGetActive(uid, "email"); err != nil || cred == nil || cred.Value != "alice@example.com" {
+		t.Errorf("unexpected active credential %v, %v", cred, err)
+	}
+}
+
+func TestTopicOwnerChange(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	heir := newTestUser(t, a)
+	subscribeTestUser(t, a, topic, heir, types.ModeCPublic)
+	reader := newTestUser(t, a)
+	subscribeTestUser(t, a, topic, reader, types.ModeCPublic)
+	stranger := newTestUser(t, a)
+
+	if err := a.TopicOwnerChange("grp"+store.GetUidString(), heir, owner); err != types.ErrNotFound {
+		t.Errorf("missing topic: expected ErrNotFound, got %v", err)
+	}
+	if err := a.TopicOwnerChange(topic, stranger, owner); err != types.ErrNotFound {
+		t.Errorf("non-subscriber: expected ErrNotFound, got %v", err)
+	}
+	if err := a.TopicOwnerChange(topic, reader, owner); err != types.ErrMalformed {
+		t.Errorf("subscriber without owner access: expected ErrMalformed, got %v", err)
+	}
+
+	// As the server does: grant ownership to the heir first, then change the owner.
+	if err := a.SubsUpdate(topic, heir,
+		map[string]interface{}{"ModeWant": types.ModeCFull, "ModeGiven": types.ModeCFull}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.TopicOwnerChange(topic, heir, reader); err != types.ErrConflict {
+		t.Errorf("stale old owner: expected ErrConflict, got %v", err)
+	}
+	if tpc, err := a.TopicGet(topic); err != nil || tpc.Owner != owner.String() {
+		t.Fatalf("owner must not change after rejected transfers, got %v, %v", tpc, err)
+	}
+
+	if err := a.TopicOwnerChange(topic, heir, owner); err != nil {
+		t.Fatal(err)
+	}
+	if tpc, err := a.TopicGet(topic); err != nil || tpc.Owner != heir.String() {
+		t.Errorf("expected the new owner, got %v, %v", tpc, err)
+	}
+	// Repeating the change is a no-op.
+	if err := a.TopicOwnerChange(topic, heir, owner); err != nil {
+		t.Errorf("repeated change: expected no error, got %v", err)
+	}
+}
+
+func TestSubscriptionGetWithPublic(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	alice := newTestUserWithPublic(t, a, "Alice")
+	bob := newTestUserWithPublic(t, a, "Bob")
+
+	// P2P: each user sees the other user's public.
+	p2p := alice.P2PName(bob)
+	initiator := &types.Subscription{User: alice.String(), Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P}
+	initiator.InitTimes()
+	invited := &types.Subscription{User: bob.String(), Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P}
+	invited.InitTimes()
+	if err := a.TopicCreateP2P(initiator, invited); err != nil {
+		t.Fatal(err)
+	}
+	for user, public := range map[types.Uid]string{alice: "Bob", bob: "Alice"} {
+		sub, err := a.SubscriptionGetWithPublic(p2p, user)
+		if err != nil || sub == nil || sub.GetPublic() != public {
+			t.Errorf("p2p: expected %s, got %v, %v", public, sub, err)
+		}
+	}
+
+	// Group: public of the topic.
+	grp := &types.Topic{ObjHeader: types.ObjHeader{Id: "grp" + store.GetUidString()}, Owner: alice.String(), Public: "Group"}
+	grp.InitTimes()
+	if err := a.TopicCreate(grp); err != nil {
+		t.Fatal(err)
+	}
+	subscribeTestUser(t, a, grp.Id, bob, types.ModeCP2P)
+	sub, err := a.SubscriptionGetWithPublic(grp.Id, bob)
+	if err != nil || sub == nil || sub.GetPublic() != "Group" {
+		t.Errorf("grp: expected Group, got %v, %v", sub, err)
+	}
+}
+
+func TestUserGetUnvalidated(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	abandoned := newTestUser(t, a)
+	newTestCred(t, a, abandoned, "email", "abandoned@example.com", false)
+	confirmed := newTestUser(t, a)
+	newTestCred(t, a, confirmed, "email", "confirmed@example.com", true)
+	recent := newTestUser(t, a)
+	newTestCred(t, a, recent, "email", "recent@example.com", false)
+
+	// Backdate the registrations except the recent one.
+	longAgo := time.Now().Add(-48 * time.Hour)
+	for _, uid := range []types.Uid{abandoned, confirmed} {
+		if _, err := a.db.Exec("UPDATE users SET createdat=? WHERE id=?", longAgo, store.DecodeUid(uid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uids, err := a.UserGetUnvalidated(time.Now().Add(-time.Hour), 10)
+	if err != nil || len(uids) != 1 || uids[0] != abandoned {
+		t.Errorf("expected only the abandoned user %s, got %v, %v", abandoned, uids, err)
+	}
+}
+
+func TestSubsUpdateCount(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	member := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	subscribeTestUser(t, a, topic, member, types.ModeCPublic)
+
+	count, err := a.SubsUpdateCount(topic, member, map[string]interface{}{"Private": "note"})
+	if err != nil || count != 1 {
+		t.Errorf("single subscription: expected 1, got %d, %v", count, err)
+	}
+	// The value is unchanged, nothing to count.
+	count, err = a.SubsUpdateCount(topic, member, map[string]interface{}{"Private": "note"})
+	if err != nil || count != 0 {
+		t.Errorf("unchanged subscription: expected 0, got %d, %v", count, err)
+	}
+	count, err = a.SubsUpdateCount("grpMissing", member, map[string]interface{}{"Private": "note"})
+	if err != nil || count != 0 {
+		t.Errorf("missing topic: expected 0, got %d, %v", count, err)
+	}
+	count, err = a.SubsUpdateCount(topic, types.ZeroUid, map[string]interface{}{"Private": "all"})
+	if err != nil || count != 2 {
+		t.Errorf("all subscriptions: expected 2, got %d, %v", count, err)
+	}
+}
+
+func TestTopicSharePartial(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	member := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+
+	// The second share references a user which does not exist and violates the foreign key.
+	var shares []*types.Subscription
+	for _, uid := range []types.Uid{member, store.GetUid()} {
+		sub := &types.Subscription{User: uid.String(), Topic: topic, ModeWant: types.ModeCPublic, ModeGiven: types.ModeCPublic}
+		sub.InitTimes()
+		shares = append(shares, sub)
+	}
+
+	count, errs, err := a.TopicSharePartial(shares)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(errs) != 2 || errs[0] != nil || errs[1] == nil {
+		t.Errorf("expected one share to succeed and one to fail, got %d, %v", count, errs)
+	}
+	if sub, err := a.SubscriptionGet(topic, member); err != nil || sub == nil {
+		t.Errorf("the valid share must be saved, got %v, %v", sub, err)
+	}
+}
+
+func TestUserUpdateIfUnmodified(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	user, err := a.UserGet(uid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := user.UpdatedAt
+
+	err = a.UserUpdateIfUnmodified(uid, stale, map[string]interface{}{
+		"UpdatedAt": stale.Add(time.Second), "Public": "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.UserUpdateIfUnmodified(uid, stale, map[string]interface{}{
+		"UpdatedAt": stale.Add(2 * time.Second), "Public": "second"})
+	if err != types.ErrConflict {
+		t.Errorf("stale update: expected ErrConflict, got %v", err)
+	}
+	if user, err = a.UserGet(uid); err != nil || user.Public != "first" {
+		t.Errorf("stale update must not be applied, got %v, %v", user, err)
+	}
+
+	err = a.UserUpdateIfUnmodified(store.GetUid(), stale, map[string]interface{}{"Public": "none"})
+	if err != types.ErrNotFound {
+		t.Errorf("missing user: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSubsDelForTopicBatched(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	for i := 0; i < 7; i++ {
+		subscribeTestUser(t, a, topic, newTestUser(t, a), types.ModeCPublic)
+	}
+
+	// 8 subscriptions including the owner's, the last batch is incomplete.
+	count, err := a.SubsDelForTopicBatched(topic, true, 3)
+	if err != nil || count != 8 {
+		t.Errorf("expected 8 deleted subscriptions, got %d, %v", count, err)
+	}
+	var left int
+	if err = a.db.Get(&left, "SELECT COUNT(*) FROM subscriptions WHERE topic=?", topic); err != nil || left != 0 {
+		t.Errorf("expected no subscriptions left, got %d, %v", left, err)
+	}
+}
+
+func TestTopicUpdateOnMessageReplay(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+
+	newer := &types.Message{SeqId: 5, Topic: topic, From: owner.String(), Content: "newer"}
+	newer.InitTimes()
+	older := &types.Message{SeqId: 3, Topic: topic, From: owner.String(), Content: "older"}
+	older.InitTimes()
+	older.CreatedAt = newer.CreatedAt.Add(-time.Minute)
+
+	for _, msg := range []*types.Message{newer, older} {
+		if err := a.TopicUpdateOnMessage(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tt, err := a.TopicGet(topic)
+	if err != nil || tt == nil {
+		t.Fatal(tt, err)
+	}
+	if tt.SeqId != 5 {
+		t.Errorf("seqid must not move backwards: expected 5, got %d", tt.SeqId)
+	}
+	if tt.TouchedAt == nil || !tt.TouchedAt.Equal(newer.CreatedAt) {
+		t.Errorf("touchedat must not move backwards: expected %v, got %v", newer.CreatedAt, tt.TouchedAt)
+	}
+}
+
+func TestReactions(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	member := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	msgs := saveTestMessages(t, a, topic, owner, 2)
+	first, second := msgs[0].Uid(), msgs[1].Uid()
+
+	for _, r := range []struct {
+		msg  types.Uid
+		user types.Uid
+	}{{first, owner}, {first, member}, {second, member}} {
+		if err := a.ReactionAdd(r.msg, r.user, "+1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.ReactionAdd(first, owner, "+1"); err != types.ErrDuplicate {
+		t.Errorf("duplicate reaction: expected ErrDuplicate, got %v", err)
+	}
+
+	if err := a.ReactionRemove(second, member, "+1"); err != nil {
+		t.Fatal(err)
+	}
+	// Removing a missing reaction is not an error.
+	if err := a.ReactionRemove(second, member, "+1"); err != nil {
+		t.Errorf("removing a missing reaction: %v", err)
+	}
+
+	reactions, err := a.ReactionsForMessages([]types.Uid{first, second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 1 || len(reactions[first]) != 2 {
+		t.Fatalf("expected two reactions to the first message only, got %v", reactions)
+	}
+	if reactions[first][0].User != owner.String() || reactions[first][1].User != member.String() {
+		t.Errorf("reactions are not in the order they were left: %v", reactions[first])
+	}
+}
+
+func TestAuthGetRecordMeta(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	if updated, err := a.AuthGetRecordMeta(uid, "basic"); err != nil || !updated.IsZero() {
+		t.Errorf("missing record: expected zero time, got %v, %v", updated, err)
+	}
+
+	if _, err := a.AuthAddRecord(uid, "basic", "basic:meta", auth.LevelAuth, []byte("secret"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	// Backdate the record so the change is detectable without sleeping.
+	longAgo := types.TimeNow().Add(-time.Hour)
+	if _, err := a.db.Exec("UPDATE auth SET updatedat=? WHERE userid=?", longAgo, store.DecodeUid(uid)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret is unchanged, the timestamp stays.
+	if _, err := a.AuthUpdRecord(uid, "basic", "basic:meta", auth.LevelAuth, []byte("secret"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := a.AuthGetRecordMeta(uid, "basic"); err != nil || !updated.Equal(longAgo) {
+		t.Errorf("unchanged secret: expected %v, got %v, %v", longAgo, updated, err)
+	}
+
+	if _, err := a.AuthUpdRecord(uid, "basic", "basic:meta", auth.LevelAuth, []byte("changed"), time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if updated, err := a.AuthGetRecordMeta(uid, "basic"); err != nil || !updated.After(longAgo) {
+		t.Errorf("changed secret: expected time after %v, got %v, %v", longAgo, updated, err)
+	}
+}
+
+func TestOutbox(t *testing.T) {
+	a := openTestDb(t, map[string]interface{}{"outbox": true})
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	msgs := saveTestMessages(t, a, topic, owner, 2)
+	single := &types.Message{SeqId: 3, Topic: topic, From: owner.String(), Content: "single"}
+	single.InitTimes()
+	if err := a.MessageSave(single); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := a.OutboxFetch(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 3 || pending[0].Uid() != msgs[0].Uid() || pending[2].Uid() != single.Uid() {
+		t.Fatalf("expected all three messages in the order they were saved, got %v", pending)
+	}
+	if pending[0].From != owner.String() || pending[2].Content != "single" {
+		t.Errorf("outbox message is not decoded: %+v", pending[2])
+	}
+
+	if err = a.OutboxAck(msgs[0].Uid(), msgs[1].Uid()); err != nil {
+		t.Fatal(err)
+	}
+	if pending, err = a.OutboxFetch(10); err != nil || len(pending) != 1 || pending[0].Uid() != single.Uid() {
+		t.Errorf("expected only the unacknowledged message, got %v, %v", pending, err)
+	}
+}
+
+func TestFileUploadTransitions(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	fd := &types.FileDef{User: uid.String(), Status: types.UploadStarted, MimeType: "text/plain", Location: "/tmp/upload"}
+	fd.SetUid(store.GetUid())
+	fd.InitTimes()
+
+	// Starting twice is not an error.
+	for i := 0; i < 2; i++ {
+		if err := a.FileStartUpload(fd); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := a.FileFinishUpload(fd.Id, types.UploadCompleted, 42); err != nil {
+		t.Fatal(err)
+	}
+	// Replay is a no-op.
+	if done, err := a.FileFinishUpload(fd.Id, types.UploadCompleted, 42); err != nil || done.Status != types.UploadCompleted {
+		t.Errorf("replayed finish: expected completed upload, got %v, %v", done, err)
+	}
+	if _, err := a.FileFinishUpload(fd.Id, types.UploadFailed, 0); err != types.ErrConflict {
+		t.Errorf("completed to failed: expected ErrConflict, got %v", err)
+	}
+
+	// Starting a completed upload again must not reset it.
+	if err := a.FileStartUpload(fd); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := a.FileGet(fd.Id); err != nil || got.Status != types.UploadCompleted || got.Size != 42 {
+		t.Errorf("completed upload was modified: %v, %v", got, err)
+	}
+
+	if _, err := a.FileFinishUpload(store.GetUidString(), types.UploadCompleted, 1); err != types.ErrNotFound {
+		t.Errorf("missing upload: expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestSubsModifiedSince(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	var members []types.Uid
+	for i := 0; i < 3; i++ {
+		member := newTestUser(t, a)
+		subscribeTestUser(t, a, topic, member, types.ModeCPublic)
+		members = append(members, member)
+	}
+	if _, err := a.db.Exec("UPDATE subscriptions SET updatedat=?", types.TimeNow().Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	since := types.TimeNow().Add(-time.Minute)
+	modified := map[string]bool{}
+	for _, member := range members[:2] {
+		if err := a.SubsUpdate(topic, member, map[string]interface{}{"UpdatedAt": types.TimeNow()}); err != nil {
+			t.Fatal(err)
+		}
+		modified[member.String()] = true
+	}
+
+	// Page through the results one subscription at a time.
+	var found []string
+	var after *types.Subscription
+	for {
+		subs, err := a.SubsModifiedSince(since, after, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) == 0 {
+			break
+		}
+		found = append(found, subs[0].User)
+		after = &subs[0]
+	}
+	if len(found) != 2 || !modified[found[0]] || !modified[found[1]] || found[0] == found[1] {
+		t.Errorf("expected only the modified subscriptions, got %v", found)
+	}
+}
+
+func TestCredDelCount(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	newTestCred(t, a, uid, "email", "validated@example.com", true)
+	newTestCred(t, a, uid, "tel", "+15550001", false)
+	if err := a.CredFail(uid, "tel"); err != nil {
+		t.Fatal(err)
+	}
+
+	if count, err := a.CredDelCount(uid, "email", "validated@example.com"); err != nil || count != 1 {
+		t.Errorf("validated credential: expected 1, got %d, %v", count, err)
+	}
+	// Attempted validation: the record is soft-deleted and counted once.
+	if count, err := a.CredDelCount(uid, "tel", "+15550001"); err != nil || count != 1 {
+		t.Errorf("attempted credential: expected 1, got %d, %v", count, err)
+	}
+	if count, err := a.CredDelCount(uid, "tel", "+15550001"); err != nil || count != 0 {
+		t.Errorf("soft-deleted credential: expected 0, got %d, %v", count, err)
+	}
+	if count, err := a.CredDelCount(uid, "email", "missing@example.com"); err != nil || count != 0 {
+		t.Errorf("missing credential: expected 0, got %d, %v", count, err)
+	}
+}
+
+func TestTopicsGetAll(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	first := newTestTopic(t, a, owner)
+	second := newTestTopic(t, a, owner)
+
+	topics, err := a.TopicsGetAll([]string{first, "grpMissing", second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := map[string]bool{}
+	for _, tt := range topics {
+		found[tt.Id] = true
+		if tt.Owner != owner.String() {
+			t.Errorf("topic %s: expected owner %s, got %s", tt.Id, owner, tt.Owner)
+		}
+	}
+	if len(topics) != 2 || !found[first] || !found[second] {
+		t.Errorf("expected only the existing topics, got %v", topics)
+	}
+
+	if topics, err = a.TopicsGetAll(nil); err != nil || len(topics) != 0 {
+		t.Errorf("no names: expected no topics, got %v, %v", topics, err)
+	}
+}
+
+func TestCredConfirmedMethods(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	if methods, err := a.CredConfirmedMethods(uid); err != nil || len(methods) != 0 {
+		t.Errorf("no credentials: expected no methods, got %v, %v", methods, err)
+	}
+
+	newTestCred(t, a, uid, "tel", "+15550002", false)
+	newTestCred(t, a, uid, "email", "confirmed@example.com", false)
+	if err := a.CredConfirm(uid, "email"); err != nil {
+		t.Fatal(err)
+	}
+
+	methods, err := a.CredConfirmedMethods(uid)
+	if err != nil || len(methods) != 1 || methods[0] != "email" {
+		t.Errorf("expected only the confirmed method, got %v, %v", methods, err)
+	}
+}
+
+func BenchmarkMessageSaveAll10(b *testing.B)   { benchmarkMessageSave(b, 10, true) }
+func BenchmarkMessageSaveAll100(b *testing.B)  { benchmarkMessageSave(b, 100, true) }
+func BenchmarkMessageSaveAll1000(b *testing.B) { benchmarkMessageSave(b, 1000, true) }
+
+// Saving messages one by one, for comparison.
+func BenchmarkMessageSave100(b *testing.B) { benchmarkMessageSave(b, 100, false) }
+
+func benchmarkMessageSave(b *testing.B, count int, batched bool) {
+	a := openTestDb(b, nil)
+	defer a.Close()
+
+	owner := newTestUser(b, a)
+	topic := newTestTopic(b, a, owner)
+
+	seq := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		msgs := make([]*types.Message, count)
+		for j := range msgs {
+			seq++
+			msgs[j] = &types.Message{SeqId: seq, Topic: topic, From: owner.String(), Content: "benchmark"}
+			msgs[j].InitTimes()
+		}
+		b.StartTimer()
+
+		if batched {
+			if err := a.MessageSaveAll(msgs); err != nil {
+				b.Fatal(err)
+			}
+			continue
+		}
+		for _, msg := range msgs {
+			if err := a.MessageSave(msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMessageGetAllDellog100(b *testing.B)  { benchmarkMessageGetAll(b, 100, false) }
+func BenchmarkMessageGetAllDellog1000(b *testing.B) { benchmarkMessageGetAll(b, 1000, false) }
+func BenchmarkMessageGetAllDellog5000(b *testing.B) { benchmarkMessageGetAll(b, 5000, false) }
+
+// Fetching all SeqIDs of the topic by ID, split into IN (...) batches.
+func BenchmarkMessageGetByIdsDellog5000(b *testing.B) { benchmarkMessageGetAll(b, 5000, true) }
+
+// benchmarkMessageGetAll fetches messages of a topic where every other message is soft-deleted
+// for the reader, i.e. dellog holds delCount single-message ranges. Either the latest page
+// is fetched by MessageGetAll or all messages by MessageGetByIds.
+func benchmarkMessageGetAll(b *testing.B, delCount int, byIds bool) {
+	a := openTestDb(b, nil)
+	defer a.Close()
+
+	owner := newTestUser(b, a)
+	topic := newTestTopic(b, a, owner)
+	saveTestMessages(b, a, topic, owner, delCount*2)
+
+	ranges := make([]types.Range, delCount)
+	for i := range ranges {
+		ranges[i] = types.Range{Low: i*2 + 1}
+	}
+	err := a.MessageDeleteList(topic, &types.DelMessage{DelId: 1, DeletedFor: owner.String(), SeqIdRanges: ranges})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	opts := &types.QueryOpt{Limit: 50}
+	seqIds := make([]int, delCount*2)
+	for i := range seqIds {
+		seqIds[i] = i + 1
+	}
+	expected := 50
+	if byIds {
+		expected = delCount
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var msgs []types.Message
+		if byIds {
+			msgs, err = a.MessageGetByIds(topic, owner, seqIds)
+		} else {
+			msgs, err = a.MessageGetAll(topic, owner, opts)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(msgs) != expected {
+			b.Fatalf("expected %d messages, got %d", expected, len(msgs))
+		}
+	}
+}
+
+func TestSubsLastSeen(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	member := newTestUser(t, a)
+	outsider := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	subscribeTestUser(t, a, topic, member, types.ModeCPublic)
+
+	// lastseen is stored with one second precision.
+	when := types.TimeNow().Add(-time.Hour).Truncate(time.Second)
+	err := a.SubsLastSeen(topic, member, map[string]interface{}{"LastSeen": when, "UserAgent": "TestAgent/1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := a.UserGet(member)
+	if err != nil || user.LastSeen == nil || !user.LastSeen.Equal(when) || user.UserAgent != "TestAgent/1.0" {
+		t.Errorf("expected %v and TestAgent/1.0, got %+v, %v", when, user, err)
+	}
+
+	// User agent alone.
+	if err = a.SubsLastSeen(topic, member, map[string]interface{}{"UserAgent": "TestAgent/2.0"}); err != nil {
+		t.Fatal(err)
+	}
+	user, err = a.UserGet(member)
+	if err != nil || user.LastSeen == nil || !user.LastSeen.Equal(when) || user.UserAgent != "TestAgent/2.0" {
+		t.Errorf("expected %v and TestAgent/2.0, got %+v, %v", when, user, err)
+	}
+
+	// The user is not subscribed to the topic.
+	if err = a.SubsLastSeen(topic, outsider, map[string]interface{}{"LastSeen": when, "UserAgent": "Outsider"}); err != nil {
+		t.Fatal(err)
+	}
+	if user, err = a.UserGet(outsider); err != nil || user.LastSeen != nil || user.UserAgent != "" {
+		t.Errorf("non-subscriber must not be updated, got %+v, %v", user, err)
+	}
+}
+
+func TestSubsLastSeenTopicsForUser(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	alice := newTestUser(t, a)
+	bob := newTestUser(t, a)
+	p2p := alice.P2PName(bob)
+	initiator := &types.Subscription{User: alice.String(), Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P}
+	initiator.InitTimes()
+	invited := &types.Subscription{User: bob.String(), Topic: p2p, ModeWant: types.ModeCP2P, ModeGiven: types.ModeCP2P}
+	invited.InitTimes()
+	if err := a.TopicCreateP2P(initiator, invited); err != nil {
+		t.Fatal(err)
+	}
+
+	when := types.TimeNow().Add(-time.Minute).Truncate(time.Second)
+	err := a.SubsLastSeen(p2p, bob, map[string]interface{}{"LastSeen": when, "UserAgent": "TestAgent/1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice sees Bob's last seen time and user agent in the p2p subscription.
+	subs, err := a.TopicsForUser(alice, false, nil)
+	if err != nil || len(subs) != 1 {
+		t.Fatalf("expected one subscription, got %v, %v", subs, err)
+	}
+	if !subs[0].GetLastSeen().Equal(when) || subs[0].GetUserAgent() != "TestAgent/1.0" {
+		t.Errorf("expected %v and TestAgent/1.0, got %v and %q", when, subs[0].GetLastSeen(), subs[0].GetUserAgent())
+	}
+}
+
+func TestMessageAttachmentsRollback(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	msgs := saveTestMessages(t, a, topic, owner, 1)
+	fd := &types.FileDef{User: owner.String(), Status: types.UploadCompleted, MimeType: "text/plain", Location: "/tmp/attached"}
+	fd.SetUid(store.GetUid())
+	fd.InitTimes()
+	if err := a.FileStartUpload(fd); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the update of fileuploads fail after the links are inserted.
+	if _, err := a.db.Exec("CREATE TRIGGER fileuploads_fail BEFORE UPDATE ON fileuploads FOR EACH ROW " +
+		"SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT='forced failure'"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.MessageAttachments(msgs[0].Uid(), []string{fd.Id}); err == nil {
+		t.Fatal("expected the update to fail")
+	}
+	var count int
+	if err := a.db.Get(&count, "SELECT COUNT(*) FROM filemsglinks"); err != nil || count != 0 {
+		t.Errorf("links must be rolled back, got %d, %v", count, err)
+	}
+}
+
+func TestCreateDbPartialFailure(t *testing.T) {
+	dsn := os.Getenv(testDSNEnv)
+	if dsn == "" {
+		t.Skip(testDSNEnv + " is not set")
+	}
+	// MEMORY tables cannot have JSON columns: the database is created but creating the first table fails.
+	cfg, err := ms.ParseDSN(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Params == nil {
+		cfg.Params = map[string]string{}
+	}
+	cfg.Params["default_storage_engine"] = "MEMORY"
+	adpConf, _ := json.Marshal(map[string]interface{}{"dsn": cfg.FormatDSN()})
+
+	a := &adapter{}
+	if err = a.Open(string(adpConf)); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	err = a.CreateDb(true)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if !strings.Contains(err.Error(), "failed to create database '"+a.dbName+"'") {
+		t.Errorf("error does not name the database: %v", err)
+	}
+	if strings.Contains(err.Error(), "was not removed") {
+		t.Errorf("partially created database must be removed: %v", err)
+	}
+
+	var count int
+	if err = a.db.Get(&count, "SELECT COUNT(*) FROM information_schema.schemata WHERE schema_name=?", a.dbName); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Error("partially created database was not dropped")
+	}
+}
+
+func TestFileDeleteUnusedAttachedConcurrently(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	msgs := saveTestMessages(t, a, topic, owner, 1)
+	var files []*types.FileDef
+	for _, loc := range []string{"/tmp/attached", "/tmp/unused"} {
+		fd := &types.FileDef{User: owner.String(), Status: types.UploadCompleted, MimeType: "text/plain", Location: loc}
+		fd.SetUid(store.GetUid())
+		fd.InitTimes()
+		if err := a.FileStartUpload(fd); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, fd)
+	}
+
+	// Both files are unused when selected.
+	var ids []int64
+	var locations []string
+	err := a.withTx(func(tx *sqlx.Tx) (err error) {
+		ids, locations, err = selectUnusedFiles(tx, time.Time{}, 0)
+		return
+	})
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("expected two unused files, got %v, %v", locations, err)
+	}
+
+	// The first file is attached before the delete.
+	if err = a.MessageAttachments(msgs[0].Uid(), []string{files[0].Id}); err != nil {
+		t.Fatal(err)
+	}
+
+	var deleted []string
+	err = a.withTx(func(tx *sqlx.Tx) (err error) {
+		deleted, err = deleteUnusedFiles(tx, ids, locations)
+		return
+	})
+	if err != nil || len(deleted) != 1 || deleted[0] != "/tmp/unused" {
+		t.Errorf("expected only the unused file to be deleted, got %v, %v", deleted, err)
+	}
+	if fd, err := a.FileGet(files[0].Id); err != nil || fd == nil {
+		t.Errorf("attached file must survive, got %v, %v", fd, err)
+	}
+	var links int
+	if err = a.db.Get(&links, "SELECT COUNT(*) FROM filemsglinks"); err != nil || links != 1 {
+		t.Errorf("expected the link to survive, got %d, %v", links, err)
+	}
+}
+
+func TestDeviceReplaceUpdatesLang(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	def := &types.DeviceDef{DeviceId: "device-lang", Platform: "android", LastSeen: types.TimeNow(), Lang: "en"}
+	if _, inserted, err := a.DeviceReplace(uid, def); err != nil || !inserted {
+		t.Fatalf("first call must insert the device, got %t, %v", inserted, err)
+	}
+
+	def.Lang = "fr"
+	prev, inserted, err := a.DeviceReplace(uid, def)
+	if err != nil || inserted || !prev.IsZero() {
+		t.Errorf("second call must update the device of the same user, got %s, %t, %v", prev, inserted, err)
+	}
+
+	devices, count, err := a.DeviceGetAll(uid)
+	if err != nil || count != 1 || devices[uid][0].Lang != "fr" {
+		t.Errorf("expected one device with lang fr, got %v, %v", devices, err)
+	}
+}
+
+func TestDeviceReplaceReportsPriorOwner(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	alice := newTestUser(t, a)
+	bob := newTestUser(t, a)
+	def := &types.DeviceDef{DeviceId: "device-shared", Platform: "ios", LastSeen: types.TimeNow(), Lang: "en"}
+	if prev, _, err := a.DeviceReplace(alice, def); err != nil || !prev.IsZero() {
+		t.Fatalf("new device must have no prior owner, got %s, %v", prev, err)
+	}
+
+	prev, inserted, err := a.DeviceReplace(bob, def)
+	if err != nil || inserted || prev != alice {
+		t.Errorf("expected the device to move from %s, got %s, %t, %v", alice, prev, inserted, err)
+	}
+
+	devices, count, err := a.DeviceGetAll(alice, bob)
+	if err != nil || count != 1 || len(devices[alice]) != 0 || len(devices[bob]) != 1 {
+		t.Errorf("the device must belong to bob only, got %v, %v", devices, err)
+	}
+}
+
+func TestSubsForUserPaging(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	var topics []string
+	for i := 0; i < 7; i++ {
+		topics = append(topics, newTestTopic(t, a, uid))
+	}
+	// Four subscriptions share the same updatedat, the rest are updated later one by one.
+	base := types.TimeNow().Add(-time.Hour)
+	for i, topic := range topics {
+		updated := base
+		if i >= 4 {
+			updated = base.Add(time.Duration(i) * time.Second)
+		}
+		if _, err := a.db.Exec("UPDATE subscriptions SET updatedat=? WHERE topic=?", updated, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]int{}
+	since := base.Add(-time.Second)
+	opts := &types.QueryOpt{IfModifiedSince: &since, Limit: 3}
+	for pages := 0; pages < len(topics); pages++ {
+		subs, err := a.SubsForUser(uid, false, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) == 0 {
+			break
+		}
+		for _, sub := range subs {
+			seen[sub.Topic]++
+		}
+		last := subs[len(subs)-1]
+		opts = &types.QueryOpt{IfModifiedSince: &last.UpdatedAt, AfterTopic: last.Topic, Limit: 3}
+	}
+
+	if len(seen) != len(topics) {
+		t.Errorf("expected %d topics, got %d: %v", len(topics), len(seen), seen)
+	}
+	for topic, count := range seen {
+		if count != 1 {
+			t.Errorf("topic %s returned %d times", topic, count)
+		}
+	}
+}
+
+func TestUserGetAllBatches(t *testing.T) {
+	a := openTestDb(t, map[string]interface{}{"in_batch_size": 2})
+	defer a.Close()
+
+	var uids []types.Uid
+	for i := 0; i < 5; i++ {
+		uids = append(uids, newTestUser(t, a))
+	}
+	// Duplicates fall into different batches.
+	request := append(append([]types.Uid{}, uids...), uids[0], uids[3])
+
+	users, err := a.UserGetAll(request...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[types.Uid]int{}
+	for i := range users {
+		seen[users[i].Uid()]++
+	}
+	if len(users) != len(uids) {
+		t.Errorf("expected %d users, got %d", len(uids), len(users))
+	}
+	for _, uid := range uids {
+		if seen[uid] != 1 {
+			t.Errorf("user %s returned %d times", uid, seen[uid])
+		}
+	}
+}
+
+func TestFindUsersTags(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	newUser := func(tags ...string) types.Uid {
+		user := &types.User{Tags: tags}
+		user.SetUid(store.GetUid())
+		user.InitTimes()
+		if err := a.UserCreate(user); err != nil {
+			t.Fatal(err)
+		}
+		return user.Uid()
+	}
+	caller := newTestUser(t, a)
+	allRequired := newUser("req1", "req2", "opt1")
+	optionalOnly := newUser("opt1")
+	none := newUser("other")
+
+	found := func(subs []types.Subscription) map[string]bool {
+		users := map[string]bool{}
+		for _, sub := range subs {
+			users[sub.User] = true
+		}
+		return users
+	}
+
+	// Required and optional tags: only the user with all required tags.
+	subs, err := a.FindUsers(caller, []string{"req1", "req2"}, []string{"opt1"})
+	if err != nil || len(subs) != 1 || subs[0].User != allRequired.String() {
+		t.Errorf("required tags: expected %s only, got %v, %v", allRequired, subs, err)
+	}
+
+	// Optional tags only: both users with the tag, the one with more matches first.
+	subs, err = a.FindUsers(caller, nil, []string{"req1", "opt1"})
+	if err != nil || len(subs) != 2 || subs[0].User != allRequired.String() || subs[1].User != optionalOnly.String() {
+		t.Errorf("optional tags: expected %s, %s, got %v, %v", allRequired, optionalOnly, subs, err)
+	}
+	if found(subs)[none.String()] {
+		t.Errorf("user without matching tags must not be found")
+	}
+
+	// No user has the tag.
+	subs, err = a.FindUsers(caller, []string{"missing"}, nil)
+	if err != nil || len(subs) != 0 {
+		t.Errorf("missing tag: expected nothing, got %v, %v", subs, err)
+	}
+}
+
+func TestFindTopicsOrder(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	base := types.TimeNow().Add(-time.Hour)
+	// The last topic is the most recently updated, the other two are updated at the same time.
+	for i, name := range []string{"grpFindOrderC", "grpFindOrderB", "grpFindOrderA"} {
+		topic := &types.Topic{ObjHeader: types.ObjHeader{Id: name}, Owner: owner.String(), Tags: []string{"common"}}
+		topic.InitTimes()
+		topic.UpdatedAt = base
+		if i == 2 {
+			topic.UpdatedAt = base.Add(time.Minute)
+		}
+		if err := a.TopicCreate(topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := []string{"grpFindOrderA", "grpFindOrderB", "grpFindOrderC"}
+
+	// The order must be the same every time.
+	for i := 0; i < 3; i++ {
+		subs, err := a.FindTopics(nil, []string{"common"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, sub := range subs {
+			got = append(got, sub.Topic)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("expected %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestUserUnreadCount(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	reader := newTestUser(t, a)
+	if count, err := a.UserUnreadCount(reader); err != nil || count != 0 {
+		t.Errorf("no subscriptions: expected 0, got %d, %v", count, err)
+	}
+
+	for _, tc := range []struct{ seq, read int }{{10, 4}, {5, 5}} {
+		topic := newTestTopic(t, a, owner)
+		subscribeTestUser(t, a, topic, reader, types.ModeCPublic)
+		if err := a.TopicUpdate(topic, map[string]interface{}{"SeqId": tc.seq}); err != nil {
+			t.Fatal(err)
+		}
+		if err := a.SubsUpdate(topic, reader, map[string]interface{}{"ReadSeqId": tc.read}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// (10-4) + (5-5)
+	if count, err := a.UserUnreadCount(reader); err != nil || count != 6 {
+		t.Errorf("expected 6 unread messages, got %d, %v", count, err)
+	}
+}
+
+func TestCredIsConfirmed(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	newTestCred(t, a, uid, "email", "confirm@example.com", false)
+	if done, err := a.CredIsConfirmed(uid, "email"); err != nil || done {
+		t.Errorf("unconfirmed credential: expected false, got %t, %v", done, err)
+	}
+
+	if err := a.CredConfirm(uid, "email"); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := a.CredIsConfirmed(uid, "email"); err != nil || !done {
+		t.Errorf("confirmed credential: expected true, got %t, %v", done, err)
+	}
+	if done, err := a.CredIsConfirmed(uid, "tel"); err != nil || done {
+		t.Errorf("missing method: expected false, got %t, %v", done, err)
+	}
+}
+
+func TestOwnTopicsDeleted(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	active := newTestTopic(t, a, owner)
+	deleted := newTestTopic(t, a, owner)
+	if err := a.TopicDelete(deleted, false); err != nil {
+		t.Fatal(err)
+	}
+
+	names, err := a.OwnTopics(owner, nil)
+	if err != nil || len(names) != 1 || names[0] != active {
+		t.Errorf("expected only %s, got %v, %v", active, names, err)
+	}
+
+	names, err = a.OwnTopics(owner, &types.QueryOpt{KeepDeleted: true})
+	if err != nil || len(names) != 2 {
+		t.Errorf("expected both topics with KeepDeleted, got %v, %v", names, err)
+	}
+}
+
+func TestCredGetAllOrder(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	newTestCred(t, a, uid, "email", "older@example.com", true)
+	newTestCred(t, a, uid, "email", "newer@example.com", true)
+	base := types.TimeNow().Add(-time.Hour)
+	for value, updated := range map[string]time.Time{"older@example.com": base, "newer@example.com": base.Add(time.Minute)} {
+		if _, err := a.db.Exec("UPDATE credentials SET updatedat=? WHERE value=?", updated, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	creds, err := a.CredGetAll(uid, "email", false)
+	if err != nil || len(creds) != 2 {
+		t.Fatalf("expected two credentials, got %v, %v", creds, err)
+	}
+	if creds[0].Value != "newer@example.com" || creds[1].Value != "older@example.com" {
+		t.Errorf("credentials must be ordered by update time, newest first: %v", creds)
+	}
+}
+
+func TestCredGetActiveNewest(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	newTestCred(t, a, uid, "email", "first@example.com", false)
+	newTestCred(t, a, uid, "email", "second@example.com", false)
+	// Adding the second credential deactivated the first one. Make both active as if left by an older version.
+	base := types.TimeNow().Add(-time.Hour)
+	if _, err := a.db.Exec("UPDATE credentials SET deletedat=NULL,createdat=?,updatedat=? WHERE value='first@example.com'",
+		base, base); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.db.Exec("UPDATE credentials SET createdat=?,updatedat=? WHERE value='second@example.com'",
+		base, base.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	cred, err := a.CredGetActive(uid, "email")
+	if err != nil || cred == nil || cred.Value != "second@example.com" {
+		t.Errorf("expected the most recently updated credential, got %v, %v", cred, err)
+	}
+
+	// Same update time: the most recently created one wins.
+	if _, err = a.db.Exec("UPDATE credentials SET createdat=?,updatedat=? WHERE value='first@example.com'",
+		base.Add(time.Second), base.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	cred, err = a.CredGetActive(uid, "email")
+	if err != nil || cred == nil || cred.Value != "first@example.com" {
+		t.Errorf("expected the most recently created credential, got %v, %v", cred, err)
+	}
+}
+
+func TestDeviceCountByPlatform(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	alice := newTestUser(t, a)
+	bob := newTestUser(t, a)
+	devices := []struct {
+		user     types.Uid
+		id       string
+		platform string
+	}{
+		{alice, "apns-1", "ios"},
+		{alice, "fcm-1", "android"},
+		{bob, "fcm-2", "android"},
+		{bob, "web-1", "web"},
+		{bob, "none-1", ""},
+	}
+	for _, dev := range devices {
+		def := &types.DeviceDef{DeviceId: dev.id, Platform: dev.platform, LastSeen: types.TimeNow()}
+		if err := a.DeviceUpsert(dev.user, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	counts, err := a.DeviceCountByPlatform(alice, bob)
+	expected := map[string]int{"ios": 1, "android": 2, "web": 1, "unknown": 1}
+	if err != nil || !reflect.DeepEqual(counts, expected) {
+		t.Errorf("expected %v, got %v, %v", expected, counts, err)
+	}
+}
+
+func TestDevicesByLang(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	alice := newTestUser(t, a)
+	bob := newTestUser(t, a)
+	for i, lang := range []string{"en", "fr", "", "en"} {
+		user := alice
+		if i%2 == 1 {
+			user = bob
+		}
+		def := &types.DeviceDef{DeviceId: fmt.Sprintf("device-%d", i), Platform: "android", LastSeen: types.TimeNow(), Lang: lang}
+		if err := a.DeviceUpsert(user, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	groups, err := a.DevicesByLang(alice, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 || len(groups["en"]) != 2 || len(groups["fr"]) != 1 || len(groups[""]) != 1 {
+		t.Errorf("expected 2 en, 1 fr and 1 without lang, got %v", groups)
+	}
+}
+
+func TestTopicMessageStats(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	if count, size, maxSeq, err := a.TopicMessageStats(topic); err != nil || count != 0 || size != 0 || maxSeq != 0 {
+		t.Errorf("empty topic: expected zeros, got %d, %d, %d, %v", count, size, maxSeq, err)
+	}
+
+	// Content is stored as JSON: "a" takes 3 bytes, "bcd" takes 5.
+	var msgs []*types.Message
+	for seq, content := range map[int]string{1: "a", 4: "bcd"} {
+		msg := &types.Message{SeqId: seq, Topic: topic, From: owner.String(), Content: content}
+		msg.InitTimes()
+		msgs = append(msgs, msg)
+	}
+	if err := a.MessageSaveAll(msgs); err != nil {
+		t.Fatal(err)
+	}
+
+	count, size, maxSeq, err := a.TopicMessageStats(topic)
+	if err != nil || count != 2 || size != 8 || maxSeq != 4 {
+		t.Errorf("expected 2 messages, 8 bytes, max seq 4, got %d, %d, %d, %v", count, size, maxSeq, err)
+	}
+}
+
+func TestTopicCreateUseBt(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	for _, useBt := range []bool{true, false} {
+		topic := &types.Topic{ObjHeader: types.ObjHeader{Id: "grp" + store.GetUidString()}, Owner: owner.String(), UseBt: useBt}
+		topic.InitTimes()
+		if err := a.TopicCreate(topic); err != nil {
+			t.Fatal(err)
+		}
+		tt, err := a.TopicGet(topic.Id)
+		if err != nil || tt == nil || tt.UseBt != useBt {
+			t.Errorf("expected usebt %t, got %v, %v", useBt, tt, err)
+		}
+	}
+}
+
+func TestTopicCreateRoundTrip(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := &types.Topic{
+		ObjHeader: types.ObjHeader{Id: "grp" + store.GetUidString()},
+		Owner:     owner.String(),
+		Access:    types.DefaultAccess{Auth: types.ModeCPublic, Anon: types.ModeRead},
+		Public:    "Round trip",
+		Tags:      []string{"alpha", "beta"},
+	}
+	topic.InitTimes()
+	if err := a.TopicCreate(topic); err != nil {
+		t.Fatal(err)
+	}
+
+	tt, err := a.TopicGet(topic.Id)
+	if err != nil || tt == nil {
+		t.Fatal(tt, err)
+	}
+	if tt.Access != topic.Access {
+		t.Errorf("access: expected %v, got %v", topic.Access, tt.Access)
+	}
+	if !reflect.DeepEqual([]string(tt.Tags), []string(topic.Tags)) {
+		t.Errorf("tags: expected %v, got %v", topic.Tags, tt.Tags)
+	}
+	if tt.Owner != owner.String() || tt.Public != "Round trip" {
+		t.Errorf("owner or public mismatch: %+v", tt)
+	}
+}
+
+func TestFileGetAll(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	uid := newTestUser(t, a)
+	var fids []string
+	for _, loc := range []string{"/tmp/first", "/tmp/second"} {
+		fd := &types.FileDef{User: uid.String(), Status: types.UploadCompleted, MimeType: "text/plain", Location: loc}
+		fd.SetUid(store.GetUid())
+		fd.InitTimes()
+		if err := a.FileStartUpload(fd); err != nil {
+			t.Fatal(err)
+		}
+		fids = append(fids, fd.Id)
+	}
+
+	// The missing file is skipped, the order of the request is kept.
+	files, err := a.FileGetAll(fids[1], store.GetUidString(), fids[0])
+	if err != nil || len(files) != 2 {
+		t.Fatalf("expected two files, got %v, %v", files, err)
+	}
+	if files[0].Id != fids[1] || files[0].Location != "/tmp/second" || files[1].Id != fids[0] {
+		t.Errorf("unexpected files: %+v, %+v", files[0], files[1])
+	}
+
+	if _, err = a.FileGetAll("not-an-id"); err != types.ErrMalformed {
+		t.Errorf("invalid ID: expected ErrMalformed, got %v", err)
+	}
+}
+
+func TestUserGetAllSlim(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	active := newTestUserWithPublic(t, a, "Active")
+	suspended := newTestUserWithPublic(t, a, "Suspended")
+	if err := a.UserUpdate(suspended, map[string]interface{}{"State": types.StateSuspended}); err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := a.UserGetAllSlim(active, suspended)
+	if err != nil || len(users) != 2 {
+		t.Fatalf("expected two users, got %v, %v", users, err)
+	}
+	states := map[types.Uid]int{}
+	for i := range users {
+		if users[i].Public != nil {
+			t.Errorf("user %s: public must not be loaded, got %v", users[i].Id, users[i].Public)
+		}
+		states[users[i].Uid()] = users[i].State
+	}
+	if states[active] != types.StateOK || states[suspended] != types.StateSuspended {
+		t.Errorf("unexpected states: %v", states)
+	}
+}
+
+func TestSubsCountForTopicUncapped(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+	a.SetMaxResults(2)
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	var members []types.Uid
+	for i := 0; i < 4; i++ {
+		member := newTestUser(t, a)
+		subscribeTestUser(t, a, topic, member, types.ModeCPublic)
+		members = append(members, member)
+	}
+	if err := a.SubsDelete(topic, members[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// Listing is capped by maxResults, counting is not.
+	if subs, err := a.SubsForTopic(topic, false, nil); err != nil || len(subs) > 2 {
+		t.Errorf("expected at most 2 subscriptions listed, got %d, %v", len(subs), err)
+	}
+	if count, err := a.SubsCountForTopic(topic, false); err != nil || count != 4 {
+		t.Errorf("expected 4 active subscriptions, got %d, %v", count, err)
+	}
+	if count, err := a.SubsCountForTopic(topic, true); err != nil || count != 5 {
+		t.Errorf("expected 5 subscriptions including deleted, got %d, %v", count, err)
+	}
+}
+
+func TestMaintain(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	saveTestMessages(t, a, topic, owner, 10)
+	if err := a.MessageDeleteList(topic, &types.DelMessage{DelId: 1, SeqIdRanges: []types.Range{{Low: 1, Hi: 5}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, optimize := range []bool{false, true} {
+		if err := a.Maintain(context.Background(), optimize); err != nil {
+			t.Errorf("optimize=%t: %v", optimize, err)
+		}
+	}
+}
+
+func TestDbStats(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	owner := newTestUser(t, a)
+	topic := newTestTopic(t, a, owner)
+	saveTestMessages(t, a, topic, owner, 10)
+	// Refresh table statistics.
+	if err := a.Maintain(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := a.DbStats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := stats.Rows["messages"]; !ok {
+		t.Errorf("no stats for messages: %v", stats.Rows)
+	}
+	for table, count := range stats.Rows {
+		if count < 0 {
+			t.Errorf("table %s: negative row count %d", table, count)
+		}
+	}
+	if stats.Size <= 0 {
+		t.Errorf("expected positive size, got %d", stats.Size)
+	}
+}
+
+func TestSoftDeleteIndexes(t *testing.T) {
+	a := openTestDb(t, nil)
+	defer a.Close()
+
+	for _, idx := range []struct{ table, index, columns string }{
+		{"topics", "topics_owner_deletedat", "owner,deletedat"},
+		{"subscriptions", "subscriptions_topic_deletedat", "topic,deletedat"},
+	} {
+		var columns string
+		if err := a.db.Get(&columns, "SELECT COALESCE(GROUP_CONCAT(column_name ORDER BY seq_in_index),'') "+
+			"FROM information_schema.statistics WHERE table_schema=DATABASE() AND table_name=? AND index_name=?",
+			idx.table, idx.index); err != nil {
+			t.Fatal(err)
+		}
+		if columns != idx.columns {
+			t.Errorf("index %s: expected columns %s, got %q", idx.index, idx.columns, columns)
+		}
+	}
+	// The single-column indexes are replaced.
+	for _, idx := range [][2]string{{"topics", "topics_owner"}, {"subscriptions", "subscriptions_topic"}} {
+		if schemaCount(t, a, "statistics", "table_name=? AND index_name=?", idx[0], idx[1]) != 0 {
+			t.Errorf("index %s on %s must be dropped", idx[1], idx[0])
+		}
+	}
+
+	// Queries served by the indexes still skip deleted rows.
+	owner := newTestUser(t, a)
+	member := newTestUser(t, a)
+	active := newTestTopic(t, a, owner)
+	deleted := newTestTopic(t, a, owner)
+	subscribeTestUser(t, a, active, member, types.ModeCPublic)
+	if err := a.TopicDelete(deleted, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.SubsDelete(active, member); err != nil {
+		t.Fatal(err)
+	}
+	if names, err := a.OwnTopics(owner, nil); err != nil || len(names) != 1 || names[0] != active {
+		t.Errorf("expected only %s, got %v, %v", active, names, err)
+	}
+	if subs, err := a.SubsForTopic(active, false, nil); err != nil || len(subs) != 1 || subs[0].User != owner.String() {
+		t.Errorf("expected only the owner's subscription, got %v, %v", subs, err)
+	}
+}
+
+func TestQueryLogDisabled(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, enabled := range []bool{false, true} {
+		a := openTestDb(t, map[string]interface{}{"log_queries": enabled})
+		// Setting up the database may log something unrelated.
+		buf.Reset()
+
+		if _, err := a.TopicGet("grpLogQueries"); err != nil {
+			t.Fatal(err)
+		}
+		a.Close()
+
+		if logged := buf.String(); enabled != strings.Contains(logged, "grpLogQueries") {
+			t.Errorf("log_queries=%t: unexpected log output %q", enabled, logged)
+		} else if !enabled && logged != "" {
+			t.Errorf("nothing must be logged when disabled, got %q", logged)
+		}
+	}
+}
@@ -1196,7 +1196,7 @@ func (a *adapter) SubscriptionGet(topic string, user t.Uid) (*t.Subscription, er
 }
 
 // Update time when the user was last attached to the topic
-func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]time.Time) error {
+func (a *adapter) SubsLastSeen(topic string, user t.Uid, lastSeen map[string]interface{}) error {
 	_, err := rdb.DB(a.dbName).Table("subscriptions").Get(topic+":"+user.String()).
 		Update(map[string]interface{}{"LastSeen": lastSeen}, rdb.UpdateOpts{Durability: "soft"}).RunWrite(a.conn)
 
@@ -48,6 +48,8 @@ const (
 	ErrPermissionDenied = StoreError("denied")
 	// ErrInvalidResponse means the client's response does not match server's expectation.
 	ErrInvalidResponse = StoreError("invalid response")
+	// ErrConflict means the object was modified concurrently.
+	ErrConflict = StoreError("conflict")
 )
 
 // Uid is a database-specific record id, suitable to be used as a primary key.
@@ -358,6 +360,10 @@ type StringSlice []string
 
 // Scan implements sql.Scanner interface.
 func (ss *StringSlice) Scan(val interface{}) error {
+	if val == nil {
+		*ss = nil
+		return nil
+	}
 	return json.Unmarshal(val.([]byte), ss)
 }
 
@@ -392,6 +398,16 @@ type User struct {
 	Devices map[string]*DeviceDef
 }
 
+// User states.
+const (
+	// StateOK is a normal active user.
+	StateOK = 0
+	// StateSuspended is a user who is temporarily not allowed to use the service.
+	StateSuspended = 1
+	// StateDeleted is a user who has been deleted but the record is retained.
+	StateDeleted = 2
+)
+
 // AccessMode is a definition of access mode bits.
 type AccessMode uint
 
@@ -644,6 +660,10 @@ type DefaultAccess struct {
 // Scan is an implementation of Scanner interface so the value can be read from SQL DBs
 // It assumes the value is serialized and stored as JSON
 func (da *DefaultAccess) Scan(val interface{}) error {
+	if val == nil {
+		*da = DefaultAccess{}
+		return nil
+	}
 	return json.Unmarshal(val.([]byte), da)
 }
 
@@ -702,6 +722,8 @@ type Subscription struct {
 	seqId int
 	// Deserialized TouchedAt from topic
 	touchedAt *time.Time
+	// Deserialized preview of the last message in the topic
+	lastMsg interface{}
 	// timestamp when the user was last online
 	lastSeen time.Time
 	// user agent string of the last online access
@@ -759,6 +781,16 @@ func (s *Subscription) SetSeqId(id int) {
 	s.seqId = id
 }
 
+// GetLastMsg returns the preview of the last message in the topic.
+func (s *Subscription) GetLastMsg() interface{} {
+	return s.lastMsg
+}
+
+// SetLastMsg sets the preview of the last message in the topic.
+func (s *Subscription) SetLastMsg(preview interface{}) {
+	s.lastMsg = preview
+}
+
 // GetLastSeen returns lastSeen.
 func (s *Subscription) GetLastSeen() time.Time {
 	return s.lastSeen
@@ -825,6 +857,9 @@ type Topic struct {
 
 	Public interface{}
 
+	// Preview of the last message in the topic
+	LastMsg interface{}
+
 	// Indexed tags for finding this topic.
 	Tags StringSlice
 
@@ -925,6 +960,14 @@ type Message struct {
 	Content interface{}
 }
 
+// Reaction is a user's reaction to a message, such as an emoji.
+type Reaction struct {
+	CreatedAt time.Time
+	// ID of the user who reacted.
+	User     string
+	Reaction string
+}
+
 // Range is a range of message SeqIDs. Low end is inclusive (closed), high end is exclusive (open): [Low, Hi).
 // If the range contains just one ID, Hi is set to 0
 type Range struct {
@@ -1002,10 +1045,23 @@ type QueryOpt struct {
 	User            Uid
 	Topic           string
 	IfModifiedSince *time.Time
+	// Paging through subscriptions ordered by UpdatedAt: name of the topic of the last subscription
+	// on the previous page. Used together with IfModifiedSince set to UpdatedAt of that subscription.
+	AfterTopic string
+	// Return only subscriptions where both want and given modes contain all of these permissions.
+	Mode AccessMode
+	// Include soft-deleted objects. Used by OwnTopics.
+	KeepDeleted bool
+	// Return only topics of these categories, all categories if empty. Used by TopicsForUser.
+	Categories []TopicCat
 	// ID-based query parameters: Messages
 	Since  int
 	Before int
-	// Common parameter
+	// Return messages in ascending order of SeqId, i.e. the oldest first. Limit then applies to
+	// the oldest messages in the range. The default is descending order.
+	Ascending bool
+	// Common parameter. Negative value removes the cap on the number of results where supported
+	// (MessageGetAll, SubsForTopic). Intended for administrative exports.
 	Limit int
 }
 
@@ -223,6 +223,10 @@ func msgOpts2storeOpts(req *MsgGetOpts) *types.QueryOpt {
 			Since:           req.SinceId,
 			Before:          req.BeforeId,
 		}
+		// Negative limit removes the cap on the number of results. Not available to clients.
+		if opts.Limit < 0 {
+			opts.Limit = 0
+		}
 	}
 	return opts
 }